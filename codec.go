@@ -9,6 +9,11 @@
 package hnsw
 
 import (
+	"bytes"
+	"encoding"
+	"fmt"
+
+	"github.com/bits-and-blooms/bitset"
 	"github.com/fogfish/faults"
 	"github.com/kelindar/binary"
 )
@@ -24,18 +29,61 @@ type Reader interface{ Get([]byte) ([]byte, error) }
 // Writer interface abstract persistent key/value storage
 type Writer interface{ Put([]byte, []byte) error }
 
-type header struct {
-	EfConstruction int
-	MLayerN        int
-	MLayer0        int
-	ML             float64
-	Size           int
-	Head           Pointer
-	Level          int
+// BatchWriter is optional extension of Writer. The index is written within
+// the batch, which is committed only if all writes succeed so that the storage
+// never exposes the half-written index.
+type BatchWriter interface {
+	Writer
+	Batch() (Batch, error)
+}
+
+// Batch of writes, applied atomically by Commit or discarded by Rollback.
+type Batch interface {
+	Writer
+	Commit() error
+	Rollback()
+}
+
+// BatchReader is optional extension of Reader, fetching multiple keys per
+// round-trip. Values are returned in order of keys, missing keys are nil.
+type BatchReader interface {
+	Reader
+	GetBatch([][]byte) ([][]byte, error)
+}
+
+// Scanner is optional extension of Reader, iterating over keys with
+// the prefix in any order. The value is valid only during the callback.
+type Scanner interface {
+	Reader
+	Scan(prefix []byte, f func(key, val []byte) error) error
+}
+
+// number of keys fetched per round-trip from BatchReader
+const batchSize = 1024
+
+// Codec of vectors (see WithCodec), it replaces reflection-based encoding of
+// vectors by Write, Read, WriteTo, ReadFrom and the write-ahead log.
+type Codec[Vector any] interface {
+	Encode(Vector) ([]byte, error)
+	Decode([]byte) (Vector, error)
 }
 
 // Write index
 func (h *HNSW[Vector]) Write(w Writer) error {
+	// operations in-flight are logged before the log is truncated
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	if err := commit(w, h.write); err != nil {
+		return err
+	}
+
+	h.checkpoint()
+
+	return h.truncateLog()
+}
+
+func (h *HNSW[Vector]) write(w Writer) error {
 	h.rwCore.Lock()
 	defer h.rwCore.Unlock()
 
@@ -48,25 +96,105 @@ func (h *HNSW[Vector]) Write(w Writer) error {
 		return err
 	}
 
-	if err := h.writeNodes(w); err != nil {
+	if err := h.writeSurface(w); err != nil {
+		return err
+	}
+
+	return h.writeNodes(w)
+}
+
+// Write only nodes changed since the last checkpoint (Write, WriteDelta or
+// Read) together with the header. The storage must contain the index state
+// at the last checkpoint. The entire index is written if there is no
+// checkpoint or the heap is rebuilt since then (e.g. compacted).
+func (h *HNSW[Vector]) WriteDelta(w Writer) error {
+	// operations in-flight are logged before the log is truncated
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	if err := commit(w, h.writeDelta); err != nil {
+		return err
+	}
+
+	h.checkpoint()
+
+	return h.truncateLog()
+}
+
+func (h *HNSW[Vector]) writeDelta(w Writer) error {
+	h.rwCore.Lock()
+	defer h.rwCore.Unlock()
+
+	for i := 0; i < heapRWSlots; i++ {
+		h.rwHeap[i].Lock()
+		defer h.rwHeap[i].Unlock()
+	}
+
+	if err := h.writeHeader(w); err != nil {
 		return err
 	}
 
+	h.rwDirty.Lock()
+	all := h.dirtyAll
+	dirty := h.dirty.Clone()
+	h.rwDirty.Unlock()
+
+	if all {
+		if err := h.writeSurface(w); err != nil {
+			return err
+		}
+
+		if err := h.writeNodes(w); err != nil {
+			return err
+		}
+	} else {
+		var bkey [5]byte
+		bkey[0] = '&'
+
+		for key, ok := dirty.NextSet(0); ok && key < uint(len(h.heap)); key, ok = dirty.NextSet(key + 1) {
+			if err := h.writeNode(w, bkey[:], Pointer(key)); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
-func (h *HNSW[Vector]) writeHeader(w Writer) error {
-	v := header{
-		EfConstruction: h.config.efConstruction,
-		MLayerN:        h.config.mLayerN,
-		MLayer0:        h.config.mLayer0,
-		ML:             h.config.mL,
-		Size:           len(h.heap),
-		Head:           h.head,
-		Level:          h.level,
+// write within the batch if the storage supports it
+func commit(w Writer, f func(Writer) error) error {
+	bw, ok := w.(BatchWriter)
+	if !ok {
+		return f(w)
 	}
 
-	b, err := binary.Marshal(v)
+	batch, err := bw.Batch()
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	if err := f(batch); err != nil {
+		batch.Rollback()
+		return err
+	}
+
+	if err := batch.Commit(); err != nil {
+		return errIO.New(err)
+	}
+
+	return nil
+}
+
+// reset tracking of changed nodes
+func (h *HNSW[Vector]) checkpoint() {
+	h.rwDirty.Lock()
+	h.dirty.ClearAll()
+	h.dirtyAll = false
+	h.rwDirty.Unlock()
+}
+
+func (h *HNSW[Vector]) writeHeader(w Writer) error {
+	b, err := encodeHeader(h.header())
 	if err != nil {
 		return errCodec.New(err)
 	}
@@ -79,22 +207,59 @@ func (h *HNSW[Vector]) writeHeader(w Writer) error {
 	return nil
 }
 
+// surface with state (e.g. codebooks of quantizer) is persisted if
+// it implements encoding.BinaryMarshaler
+func (h *HNSW[Vector]) writeSurface(w Writer) error {
+	surface, ok := h.surface.(encoding.BinaryMarshaler)
+	if !ok {
+		return nil
+	}
+
+	b, err := surface.MarshalBinary()
+	if err != nil {
+		return errCodec.New(err)
+	}
+
+	err = w.Put([]byte("&surface"), b)
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	return nil
+}
+
 func (h *HNSW[Vector]) writeNodes(w Writer) error {
 	var bkey [5]byte
 	bkey[0] = '&'
 
-	for key, node := range h.heap {
-		binary.LittleEndian.PutUint32(bkey[1:], uint32(key))
-
-		b, err := binary.Marshal(node)
-		if err != nil {
-			return errCodec.New(err)
+	for key := range h.heap {
+		if err := h.writeNode(w, bkey[:], Pointer(key)); err != nil {
+			return err
 		}
+	}
 
-		err = w.Put(bkey[:], b)
-		if err != nil {
-			return errIO.New(err)
-		}
+	return nil
+}
+
+func (h *HNSW[Vector]) writeNode(w Writer, bkey []byte, addr Pointer) error {
+	binary.LittleEndian.PutUint32(bkey[1:], addr)
+
+	node := h.heap[addr]
+	v, ok := h.resolve(addr, node.Vector)
+	if !ok {
+		return h.Err()
+	}
+	node.Vector = v
+
+	b, err := h.encodeNode(node)
+	if err != nil {
+		return errCodec.New(err)
+	}
+	b = seal(b)
+
+	err = w.Put(bkey, b)
+	if err != nil {
+		return errIO.New(err)
 	}
 
 	return nil
@@ -102,6 +267,15 @@ func (h *HNSW[Vector]) writeNodes(w Writer) error {
 
 // Read index
 func (h *HNSW[Vector]) Read(r Reader) error {
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	return h.read(r, nil)
+}
+
+// read index, vectors are left in the storage if lazy loader is defined.
+// The caller must hold write lock of compaction.
+func (h *HNSW[Vector]) read(r Reader, lazy *lazy[Vector]) (err error) {
 	h.rwCore.Lock()
 	defer h.rwCore.Unlock()
 
@@ -110,45 +284,142 @@ func (h *HNSW[Vector]) Read(r Reader) error {
 		defer h.rwHeap[i].Unlock()
 	}
 
-	if err := h.readHeader(r); err != nil {
+	r, v, version, err := h.migrate(r)
+	if err != nil {
 		return err
 	}
 
-	if err := h.readNodes(r); err != nil {
+	// the index remains intact if the storage is corrupted
+	config, heap, head, level, created, prev := h.config, h.heap, h.head, h.level, h.created, h.lazy
+	defer func() {
+		if err != nil {
+			h.config, h.heap, h.head, h.level, h.created, h.lazy = config, heap, head, level, created, prev
+		}
+	}()
+
+	h.withHeader(v)
+	h.heap = make([]Node[Vector], v.Size)
+
+	if err := h.readSurface(r); err != nil {
 		return err
 	}
 
+	if lazy != nil {
+		lazy.reader = r
+		lazy.version = version
+	}
+
+	h.lazy = lazy
+	if err := h.readNodes(r, version); err != nil {
+		return err
+	}
+
+	if len(h.heap) > 0 {
+		head, _ := h.resolve(h.head, h.heap[h.head].Vector)
+		if err := checkDimension(v, head); err != nil {
+			return err
+		}
+	}
+
+	h.checkpoint()
+
+	// nodes of older layout are rewritten by WriteDelta
+	if version < formatVersion {
+		h.rwDirty.Lock()
+		h.dirtyAll = true
+		h.rwDirty.Unlock()
+	}
+
 	return nil
 }
 
-func (h *HNSW[Vector]) readHeader(r Reader) error {
-	var v header
-
+func readHeader(r Reader) (header, int, error) {
 	b, err := r.Get([]byte("&root"))
+	if err != nil {
+		return header{}, 0, errIO.New(err)
+	}
+
+	v, version, err := decodeHeader(b)
+	if err != nil {
+		return header{}, 0, errCodec.New(err)
+	}
+
+	return v, version, nil
+}
+
+// surface state is restored if it implements encoding.BinaryUnmarshaler
+func (h *HNSW[Vector]) readSurface(r Reader) error {
+	surface, ok := h.surface.(encoding.BinaryUnmarshaler)
+	if !ok {
+		return nil
+	}
+
+	b, err := r.Get([]byte("&surface"))
 	if err != nil {
 		return errIO.New(err)
 	}
 
-	if err := binary.Unmarshal(b, &v); err != nil {
+	if len(b) == 0 {
+		return nil
+	}
+
+	if err := surface.UnmarshalBinary(b); err != nil {
 		return errCodec.New(err)
 	}
 
-	h.config.efConstruction = v.EfConstruction
-	h.config.mLayerN = v.MLayerN
-	h.config.mLayer0 = v.MLayer0
-	h.config.mL = v.ML
-	h.heap = make([]Node[Vector], v.Size)
-	h.head = v.Head
-	h.level = v.Level
+	return nil
+}
+
+func (h *HNSW[Vector]) readNodes(r Reader, version int) error {
+	var seen bitset.BitSet
+
+	err := forNodes(r, len(h.heap),
+		func(addr Pointer, b []byte) error {
+			seen.Set(uint(addr))
+			return h.loadNode(addr, b, version)
+		},
+	)
+	if err != nil {
+		return err
+	}
+
+	if addr, ok := seen.NextClear(0); ok && addr < uint(len(h.heap)) {
+		return errNodeMissing.New(errMissing, Pointer(addr))
+	}
+
+	return h.checkPointers()
+}
+
+func (h *HNSW[Vector]) loadNode(addr Pointer, b []byte, version int) error {
+	node, err := h.unsealNode(addr, b, version)
+	if err != nil {
+		return err
+	}
+	h.heap[addr] = node
+
+	if h.lazy != nil {
+		h.heap[addr].Vector = *new(Vector)
+		h.lazy.disk.Set(uint(addr))
+	}
 
 	return nil
 }
 
-func (h *HNSW[Vector]) readNodes(r Reader) error {
+// iterate over encoded nodes of the heap, nodes are scanned or fetched in
+// batches if the storage supports it. Missing nodes are either skipped or
+// reported as empty values.
+func forNodes(r Reader, size int, f func(Pointer, []byte) error) error {
+	switch r := r.(type) {
+	case Scanner:
+		return scanNodes(r, size, f)
+	case BatchReader:
+		return forNodesBatch(r, size, f)
+	}
+
 	var bkey [5]byte
 	bkey[0] = '&'
 
-	for key := 0; key < len(h.heap); key++ {
+	for key := 0; key < size; key++ {
 		binary.LittleEndian.PutUint32(bkey[1:], uint32(key))
 
 		b, err := r.Get(bkey[:])
@@ -156,10 +427,192 @@ func (h *HNSW[Vector]) readNodes(r Reader) error {
 			return errIO.New(err)
 		}
 
-		if err := binary.Unmarshal(b, &h.heap[key]); err != nil {
-			return errCodec.New(err)
+		if err := f(Pointer(key), b); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func forNodesBatch(r BatchReader, size int, f func(Pointer, []byte) error) error {
+	keys := make([][]byte, 0, batchSize)
+
+	for from := 0; from < size; from += batchSize {
+		keys = keys[:0]
+		for key := from; key < min(from+batchSize, size); key++ {
+			keys = append(keys, nodeKey(Pointer(key)))
+		}
+
+		vals, err := r.GetBatch(keys)
+		if err != nil {
+			return errIO.New(err)
+		}
+
+		for i, b := range vals {
+			if err := f(Pointer(from+i), b); err != nil {
+				return err
+			}
 		}
 	}
 
 	return nil
 }
+
+func scanNodes(r Scanner, size int, f func(Pointer, []byte) error) error {
+	var errNode error
+
+	err := r.Scan([]byte("&"),
+		func(key, val []byte) error {
+			// metadata keys (e.g. &root) and nodes of compacted heap are skipped
+			if len(key) != 5 || string(key) == "&root" {
+				return nil
+			}
+
+			addr := binary.LittleEndian.Uint32(key[1:])
+			if int(addr) >= size {
+				return nil
+			}
+
+			errNode = f(addr, bytes.Clone(val))
+			return errNode
+		},
+	)
+	if errNode != nil {
+		return errNode
+	}
+
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	return nil
+}
+
+func nodeKey(addr Pointer) []byte {
+	bkey := make([]byte, 5)
+	bkey[0] = '&'
+	binary.LittleEndian.PutUint32(bkey[1:], addr)
+	return bkey
+}
+
+//------------------------------------------------------------------------------
+
+// codec configured by WithCodec, it must match the vector type
+func codecOf[Vector any](codec any) Codec[Vector] {
+	if codec == nil {
+		return nil
+	}
+
+	c, ok := codec.(Codec[Vector])
+	if !ok {
+		panic(fmt.Sprintf("hnsw: codec %T does not support vectors %T", codec, *new(Vector)))
+	}
+
+	return c
+}
+
+// vectors are encoded by reflection unless the codec is configured
+func (h *HNSW[Vector]) encodeVector(v Vector) ([]byte, error) {
+	if h.codec == nil {
+		return binary.Marshal(v)
+	}
+
+	return h.codec.Encode(v)
+}
+
+func (h *HNSW[Vector]) decodeVector(b []byte) (Vector, error) {
+	if h.codec == nil {
+		var v Vector
+		err := binary.Unmarshal(b, &v)
+		return v, err
+	}
+
+	return h.codec.Decode(b)
+}
+
+// node is encoded by reflection unless the codec is configured, otherwise
+// layout is | deleted | levels | edges | pointers ... | ... | vector |
+// using little endian uint32 for numbers.
+func (h *HNSW[Vector]) encodeNode(node Node[Vector]) ([]byte, error) {
+	if h.codec == nil {
+		return binary.Marshal(node)
+	}
+
+	vec, err := h.codec.Encode(node.Vector)
+	if err != nil {
+		return nil, err
+	}
+
+	size := 5
+	for _, edges := range node.Connections {
+		size += 4 + 4*len(edges)
+	}
+
+	b := make([]byte, size, size+len(vec))
+	if node.Deleted {
+		b[0] = 1
+	}
+	binary.LittleEndian.PutUint32(b[1:], uint32(len(node.Connections)))
+
+	at := 5
+	for _, edges := range node.Connections {
+		binary.LittleEndian.PutUint32(b[at:], uint32(len(edges)))
+		at += 4
+		for _, e := range edges {
+			binary.LittleEndian.PutUint32(b[at:], e)
+			at += 4
+		}
+	}
+
+	return append(b, vec...), nil
+}
+
+func (h *HNSW[Vector]) decodeNode(b []byte, node *Node[Vector], version int) error {
+	if h.codec == nil && version == 0 {
+		return decodeLegacyNode(b, node)
+	}
+
+	if h.codec == nil {
+		return binary.Unmarshal(b, node)
+	}
+
+	if len(b) < 5 {
+		return fmt.Errorf("truncated node")
+	}
+
+	node.Deleted = b[0] == 1
+	levels := int(binary.LittleEndian.Uint32(b[1:]))
+	if levels > (len(b)-5)/4 {
+		return fmt.Errorf("invalid number of levels %d", levels)
+	}
+
+	at := 5
+	node.Connections = make([][]Pointer, levels)
+	for lvl := range node.Connections {
+		if len(b) < at+4 {
+			return fmt.Errorf("truncated node")
+		}
+
+		size := int(binary.LittleEndian.Uint32(b[at:]))
+		at += 4
+		if size > (len(b)-at)/4 {
+			return fmt.Errorf("invalid number of edges %d", size)
+		}
+
+		edges := make([]Pointer, size)
+		for e := range edges {
+			edges[e] = binary.LittleEndian.Uint32(b[at:])
+			at += 4
+		}
+		node.Connections[lvl] = edges
+	}
+
+	v, err := h.codec.Decode(b[at:])
+	if err != nil {
+		return err
+	}
+	node.Vector = v
+
+	return nil
+}
@@ -0,0 +1,133 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+// Address of non-existing node
+const nilPointer = ^Pointer(0)
+
+// Compact heap, reclaiming slots of deleted nodes.
+//
+// Nodes rejected by keep function are deleted before compaction, use nil to
+// keep all alive nodes. Deletions are recorded into write-ahead log (see
+// WithWAL). Deletion repairs neighborhood of dropped nodes
+// concurrently with search operations, the index is blocked only while
+// pointers are remapped to the new heap. Compaction invalidates previously
+// obtained pointers, the persistent storage has to be re-written using Write.
+// The heap of disk-resident index (see ReadLazy) is not compacted, rejected
+// nodes are deleted only.
+//
+// It returns number of reclaimed heap slots.
+func (h *HNSW[Vector]) Compact(keep func(Vector) bool) int {
+	return h.compactWith(keep, nil)
+}
+
+// compaction with the hook to remap external references to nodes,
+// the hook is called while the index is blocked.
+func (h *HNSW[Vector]) compactWith(keep func(Vector) bool, remapped func([]Pointer)) int {
+	if keep != nil {
+		h.rwCompact.RLock()
+		h.drop(keep)
+		h.rwCompact.RUnlock()
+	}
+
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	h.rwCore.Lock()
+	defer h.rwCore.Unlock()
+
+	// pointers address vectors in the storage
+	if h.lazy != nil {
+		return 0
+	}
+
+	size := len(h.heap)
+	remap := h.compact()
+
+	h.rwDirty.Lock()
+	h.dirtyAll = true
+	h.rwDirty.Unlock()
+
+	if remapped != nil {
+		remapped(remap)
+	}
+
+	return size - len(h.heap)
+}
+
+// delete nodes rejected by keep function
+func (h *HNSW[Vector]) drop(keep func(Vector) bool) {
+	h.rwCore.RLock()
+	size := len(h.heap)
+	h.rwCore.RUnlock()
+
+	for addr := 0; addr < size; addr++ {
+		if h.deleted(Pointer(addr)) {
+			continue
+		}
+
+		v, ok := h.load(Pointer(addr))
+		if ok && !keep(v) {
+			// the log is written ahead, the node is deleted once replayed
+			h.log(walDelete, v)
+			h.deletePointer(Pointer(addr))
+		}
+	}
+}
+
+// rewrite heap without deleted nodes, remapping all pointers.
+// It returns remap table from old to new address, deleted nodes are
+// remapped to nilPointer.
+func (h *HNSW[Vector]) compact() []Pointer {
+	remap := make([]Pointer, len(h.heap))
+	size := 0
+	for addr, node := range h.heap {
+		remap[addr] = nilPointer
+		if !node.Deleted {
+			remap[addr] = Pointer(size)
+			size++
+		}
+	}
+
+	heap := make([]Node[Vector], 0, size)
+	for _, node := range h.heap {
+		if node.Deleted {
+			continue
+		}
+
+		conns := make([][]Pointer, len(node.Connections))
+		for lvl, edges := range node.Connections {
+			conns[lvl] = make([]Pointer, 0, len(edges))
+			for _, e := range edges {
+				if !h.heap[e].Deleted {
+					conns[lvl] = append(conns[lvl], remap[e])
+				}
+			}
+		}
+
+		heap = append(heap, Node[Vector]{Vector: node.Vector, Connections: conns})
+	}
+
+	deleted := size > 0 && h.heap[h.head].Deleted
+	h.heap = heap
+
+	switch {
+	case size == 0:
+		h.head = 0
+		h.level = 0
+	case deleted:
+		h.head = 0
+		h.level = 0
+		h.electHead()
+	default:
+		h.head = remap[h.head]
+	}
+
+	return remap
+}
@@ -0,0 +1,194 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"context"
+	"slices"
+
+	"github.com/fogfish/hnsw/internal/types"
+)
+
+// Delete vector
+//
+// The node is tombstoned, it remains in the heap as a routing point for
+// graph traversal but never returned by search. Neighbors of the node are
+// reconnected to keep the graph navigable. It returns false if the vector
+// is not found. Errors of write-ahead log are reported by WAL.Err.
+func (h *HNSW[Vector]) Delete(v Vector) bool {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	addr, has := h.lookup(v)
+	if !has || !h.deletePointer(addr) {
+		return false
+	}
+
+	h.log(walDelete, h.vector(addr))
+	return true
+}
+
+// Delete node at the address. See Delete for details.
+func (h *HNSW[Vector]) DeletePointer(addr Pointer) bool {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	if !h.deletePointer(addr) {
+		return false
+	}
+
+	h.log(walDelete, h.vector(addr))
+	return true
+}
+
+func (h *HNSW[Vector]) deletePointer(addr Pointer) bool {
+	h.rwCore.RLock()
+	size := len(h.heap)
+	h.rwCore.RUnlock()
+
+	if int(addr) >= size {
+		return false
+	}
+
+	var node Node[Vector]
+	h.update(addr, func(n *Node[Vector]) {
+		node = *n
+		n.Deleted = true
+	})
+	if node.Deleted {
+		return false
+	}
+	h.touch(addr)
+
+	//
+	// Repair neighborhood
+	//
+
+	for lvl, edges := range node.Connections {
+		for _, e := range edges {
+			h.unlink(lvl, e, addr, edges)
+		}
+	}
+
+	//
+	// Update Heap
+	//
+
+	h.rwCore.Lock()
+	if h.head == addr {
+		h.electHead()
+	}
+	h.rwCore.Unlock()
+
+	return true
+}
+
+// lookup address of the vector
+func (h *HNSW[Vector]) lookup(v Vector) (Pointer, bool) {
+	h.rwCore.RLock()
+	if len(h.heap) == 0 {
+		h.rwCore.RUnlock()
+		return 0, false
+	}
+	head := h.head
+	hLevel := h.level
+	h.rwCore.RUnlock()
+
+	for lvl := hLevel - 1; lvl >= 0; lvl-- {
+		head = h.skip(lvl, head, v)
+	}
+
+	w := h.searchLayer(context.Background(), 0, head, v, h.config.efConstruction, nil)
+	if w.Len() == 0 {
+		return 0, false
+	}
+
+	for w.Len() > 1 {
+		w.Deq()
+	}
+
+	c := w.Deq()
+	if minEps < c.Distance && c.Distance < maxEps {
+		if cv, ok := h.load(c.Addr); ok && h.surface.Equal(cv, v) {
+			return c.Addr, true
+		}
+	}
+
+	return 0, false
+}
+
+// unlink deleted node from the neighbor at the level. The neighbor is
+// reconnected to the closest nodes among its own edges and edges of deleted node.
+func (h *HNSW[Vector]) unlink(level int, addr, gone Pointer, heirs []Pointer) {
+	M := h.config.mLayerN
+	if level == 0 {
+		M = h.config.mLayer0
+	}
+
+	node := h.node(addr)
+	if node.Deleted || len(node.Connections) <= level {
+		return
+	}
+
+	edges := node.Connections[level]
+	if !slices.Contains(edges, gone) {
+		return
+	}
+
+	candidates := make([]types.Vertex, 0, len(edges)+len(heirs))
+	seen := make([]Pointer, 0, len(edges)+len(heirs))
+	base, ok := h.load(addr)
+	if !ok {
+		return
+	}
+
+	for _, set := range [][]Pointer{edges, heirs} {
+		for _, e := range set {
+			if e == addr || e == gone || slices.Contains(seen, e) || h.deleted(e) {
+				continue
+			}
+			seen = append(seen, e)
+
+			ev, ok := h.load(e)
+			if !ok {
+				continue
+			}
+
+			dist := h.surface.Distance(base, ev)
+			candidates = append(candidates, types.Vertex{Distance: dist, Addr: e})
+		}
+	}
+	slices.SortFunc(candidates, types.OrdForwardVertex.Compare)
+
+	conns := h.selectNeighbors(level, base, candidates, M, addr, gone)
+
+	// edges appended while connections are selected are kept
+	h.update(addr, func(n *Node[Vector]) {
+		n.Connections[level] = merge(conns, n.Connections[level], edges)
+	})
+	h.touch(addr)
+}
+
+// elect new head (entry point) among alive nodes at the highest level.
+// The head is not changed if all nodes are deleted.
+func (h *HNSW[Vector]) electHead() {
+	head, level := h.head, 0
+
+	for addr, node := range h.heap {
+		if !node.Deleted && len(node.Connections) > level {
+			head = Pointer(addr)
+			level = len(node.Connections)
+		}
+	}
+
+	if level > 0 {
+		h.head = head
+		h.level = level
+	}
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"context"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw/internal/pq"
+	"github.com/fogfish/hnsw/internal/types"
+)
+
+// Number of nodes sampled to estimate selectivity of the filter
+const filterSampleSize = 256
+
+// Search K-nearest vectors from the graph, admitting only vectors accepted
+// by the filter into results.
+//
+// The graph is traversed through rejected nodes, so that the search returns
+// K results even if matching vectors are sparse. The search falls back to
+// brute force scan if the filter is very selective (see WithFilterThreshold).
+//
+//	index.SearchWithFilter(query, 10, 100,
+//		func(e Embedding) bool { return e.Lang == "en" },
+//	)
+func (h *HNSW[Vector]) SearchWithFilter(q Vector, K int, efSearch int, filter func(Vector) bool) []Neighbor[Vector] {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	f := func(_ Pointer, v Vector) bool { return filter(v) }
+
+	size := h.Size()
+	if h.selectivity(size, f) < h.config.filterThreshold {
+		return h.neighbors(h.bruteForce(size, q, K, f))
+	}
+
+	return h.neighbors(h.search(context.Background(), q, K, efSearch, f))
+}
+
+// Search K-nearest vectors from the graph, admitting only nodes which
+// addresses are defined in the set into results. See SearchWithFilter
+// for details.
+func (h *HNSW[Vector]) SearchWithin(q Vector, K int, efSearch int, allowed *bitset.BitSet) []Neighbor[Vector] {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	f := func(addr Pointer, _ Vector) bool { return allowed.Test(uint(addr)) }
+
+	size := h.Size()
+	if size == 0 || float64(allowed.Count())/float64(size) < h.config.filterThreshold {
+		return h.neighbors(h.bruteForce(size, q, K, f))
+	}
+
+	return h.neighbors(h.search(context.Background(), q, K, efSearch, f))
+}
+
+// estimate fraction of alive nodes accepted by the filter
+func (h *HNSW[Vector]) selectivity(size int, filter func(Pointer, Vector) bool) float64 {
+	step := max(1, size/filterSampleSize)
+	seen, accepted := 0, 0
+
+	for addr := 0; addr < size; addr += step {
+		if h.deleted(Pointer(addr)) {
+			continue
+		}
+
+		v, ok := h.load(Pointer(addr))
+		if !ok {
+			continue
+		}
+
+		seen++
+		if filter(Pointer(addr), v) {
+			accepted++
+		}
+	}
+
+	if seen == 0 {
+		return 0
+	}
+
+	return float64(accepted) / float64(seen)
+}
+
+// scan the heap for K-nearest vectors accepted by the filter
+func (h *HNSW[Vector]) bruteForce(size int, q Vector, K int, filter func(Pointer, Vector) bool) pq.Queue[types.Vertex] {
+	w := pq.New(types.OrdReverseVertex)
+
+	for addr := 0; addr < size; addr++ {
+		v, ok := h.load(Pointer(addr))
+		if !ok || !h.admit(Pointer(addr), v, filter) {
+			continue
+		}
+
+		dist := h.surface.Distance(v, q)
+		switch {
+		case w.Len() < K:
+			w.Enq(types.Vertex{Distance: dist, Addr: Pointer(addr)})
+		case dist < w.Head().Distance:
+			w.Enq(types.Vertex{Distance: dist, Addr: Pointer(addr)})
+			w.Deq()
+		}
+	}
+
+	return w
+}
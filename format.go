@@ -0,0 +1,323 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"fmt"
+	"reflect"
+	"time"
+
+	"github.com/kelindar/binary"
+)
+
+// Header of the persisted index
+//
+//	magic "HNSW" | version uint32 | binary header
+//
+// The header of legacy layout (version 0) is binary encoded parameters of
+// the graph without magic and metadata. Since version 2, each node is sealed
+// by CRC32 (Castagnoli) checksum of its encoding (little endian uint32).
+const (
+	formatMagic   = "HNSW"
+	formatVersion = 2
+)
+
+// Metadata of the persisted index
+type Metadata struct {
+	// Version of the format, 0 is legacy layout without metadata
+	Version int
+
+	// Dimension of vectors
+	Dimension int
+
+	// Name of surface distance function
+	Surface string
+
+	// Name of vector type
+	Vector string
+
+	// Name of vector codec, empty if vectors are encoded by reflection
+	Codec string
+
+	// Creation time of the index
+	Created time.Time
+}
+
+// Migration upgrades the persisted index (see WithMigration). It receives
+// metadata of the persisted index and returns the reader of upgraded one.
+type Migration func(Metadata, Reader) (Reader, error)
+
+type header struct {
+	EfConstruction int
+	MLayerN        int
+	MLayer0        int
+	ML             float64
+	Size           int
+	Head           Pointer
+	Level          int
+	Dimension      int
+	Surface        string
+	Vector         string
+	Codec          string
+	Created        int64
+}
+
+// header of legacy layout (version 0)
+type legacyHeader struct {
+	EfConstruction int
+	MLayerN        int
+	MLayer0        int
+	ML             float64
+	Size           int
+	Head           Pointer
+	Level          int
+}
+
+// node of legacy layout (version 0) without deleted flag
+type legacyNode[Vector any] struct {
+	Vector      Vector
+	Connections [][]Pointer
+}
+
+func decodeLegacyNode[Vector any](b []byte, node *Node[Vector]) error {
+	var v legacyNode[Vector]
+	if err := binary.Unmarshal(b, &v); err != nil {
+		return err
+	}
+
+	node.Vector, node.Connections = v.Vector, v.Connections
+	return nil
+}
+
+func (h *HNSW[Vector]) header() header {
+	v := header{
+		EfConstruction: h.config.efConstruction,
+		MLayerN:        h.config.mLayerN,
+		MLayer0:        h.config.mLayer0,
+		ML:             h.config.mL,
+		Size:           len(h.heap),
+		Head:           h.head,
+		Level:          h.level,
+		Surface:        surfaceName(h.surface),
+		Vector:         reflect.TypeFor[Vector]().String(),
+		Codec:          codecName(h.codec),
+		Created:        h.created.UnixNano(),
+	}
+
+	if len(h.heap) > 0 {
+		head, _ := h.resolve(h.head, h.heap[h.head].Vector)
+		v.Dimension = dimension(head)
+	}
+
+	return v
+}
+
+func (h *HNSW[Vector]) withHeader(v header) {
+	h.config.efConstruction = v.EfConstruction
+	h.config.mLayerN = v.MLayerN
+	h.config.mLayer0 = v.MLayer0
+	h.config.mL = v.ML
+	h.head = v.Head
+	h.level = v.Level
+
+	if v.Created != 0 {
+		h.created = time.Unix(0, v.Created)
+	}
+}
+
+func encodeHeader(v header) ([]byte, error) {
+	b, err := binary.Marshal(v)
+	if err != nil {
+		return nil, err
+	}
+
+	prefix := binary.LittleEndian.AppendUint32([]byte(formatMagic), formatVersion)
+	return append(prefix, b...), nil
+}
+
+func decodeHeader(b []byte) (header, int, error) {
+	if len(b) < 8 || string(b[:4]) != formatMagic {
+		v, err := decodeLegacyHeader(b)
+		return v, 0, err
+	}
+
+	// unknown versions are rejected by compatibility check
+	version := int(binary.LittleEndian.Uint32(b[4:]))
+	if version > formatVersion {
+		return header{}, version, nil
+	}
+
+	var v header
+	if err := binary.Unmarshal(b[8:], &v); err != nil {
+		return header{}, version, err
+	}
+
+	return v, version, nil
+}
+
+func decodeLegacyHeader(b []byte) (header, error) {
+	var v legacyHeader
+	if err := binary.Unmarshal(b, &v); err != nil {
+		return header{}, err
+	}
+
+	return header{
+		EfConstruction: v.EfConstruction,
+		MLayerN:        v.MLayerN,
+		MLayer0:        v.MLayer0,
+		ML:             v.ML,
+		Size:           v.Size,
+		Head:           v.Head,
+		Level:          v.Level,
+	}, nil
+}
+
+func metadata(v header, version int) Metadata {
+	m := Metadata{
+		Version:   version,
+		Dimension: v.Dimension,
+		Surface:   v.Surface,
+		Vector:    v.Vector,
+		Codec:     v.Codec,
+	}
+
+	if v.Created != 0 {
+		m.Created = time.Unix(0, v.Created)
+	}
+
+	return m
+}
+
+// check that the persisted index is readable by this instance, metadata
+// is not validated for legacy layout.
+func (h *HNSW[Vector]) compatible(v header, version int) error {
+	switch {
+	case version > formatVersion:
+		return errCodec.New(fmt.Errorf("unsupported version %d", version))
+	case version == 0:
+		return nil
+	}
+
+	if vector := reflect.TypeFor[Vector]().String(); v.Vector != vector {
+		return errCodec.New(fmt.Errorf("incompatible vector %s, index is written with %s", vector, v.Vector))
+	}
+
+	if surface := surfaceName(h.surface); v.Surface != surface {
+		return errCodec.New(fmt.Errorf("incompatible surface %s, index is written with %s", surface, v.Surface))
+	}
+
+	if codec := codecName(h.codec); v.Codec != codec {
+		return errCodec.New(fmt.Errorf("incompatible codec %q, index is written with %q", codec, v.Codec))
+	}
+
+	return nil
+}
+
+// read header, migrations are applied if the persisted index is written
+// by older version of the format or it is incompatible with this instance.
+func (h *HNSW[Vector]) migrate(r Reader) (Reader, header, int, error) {
+	v, version, err := readHeader(r)
+	if err != nil {
+		return nil, header{}, 0, err
+	}
+
+	if version == formatVersion && h.compatible(v, version) == nil {
+		return r, v, version, nil
+	}
+
+	for _, migration := range h.config.migrations {
+		r, err = migration(metadata(v, version), r)
+		if err != nil {
+			return nil, header{}, 0, errCodec.New(err)
+		}
+
+		v, version, err = readHeader(r)
+		if err != nil {
+			return nil, header{}, 0, err
+		}
+	}
+
+	if err := h.compatible(v, version); err != nil {
+		return nil, header{}, 0, err
+	}
+
+	return r, v, version, nil
+}
+
+// dimension of vectors read from the storage must match the header
+func checkDimension(v header, vector any) error {
+	if v.Dimension == 0 {
+		return nil
+	}
+
+	if d := dimension(vector); d != v.Dimension {
+		return errCodec.New(fmt.Errorf("invalid dimension %d, index is written with %d", d, v.Dimension))
+	}
+
+	return nil
+}
+
+//------------------------------------------------------------------------------
+
+// name of surface, the surface wrapped by vector.ContraMap is unwrapped.
+// Package of the type is omitted, it depends on the platform (e.g. SIMD).
+func surfaceName(surface any) string {
+	if surface == nil {
+		return ""
+	}
+
+	t, v := reflect.TypeOf(surface), reflect.ValueOf(surface)
+	for t.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return t.Elem().Name()
+		}
+		t, v = t.Elem(), v.Elem()
+	}
+
+	if t.Kind() == reflect.Struct {
+		if f := v.FieldByName("Surface"); f.IsValid() && f.Kind() == reflect.Interface && f.CanInterface() && !f.IsNil() {
+			return surfaceName(f.Interface())
+		}
+	}
+
+	return t.Name()
+}
+
+func codecName(codec any) string {
+	if codec == nil {
+		return ""
+	}
+
+	return reflect.TypeOf(codec).String()
+}
+
+// dimension of the vector, it is length of the vector itself or
+// its first attribute that is a sequence (e.g. vector.VF32).
+func dimension(vector any) int {
+	v := reflect.ValueOf(vector)
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return 0
+		}
+		v = v.Elem()
+	}
+
+	switch v.Kind() {
+	case reflect.Slice, reflect.Array:
+		return v.Len()
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			if f := v.Field(i); f.Kind() == reflect.Slice || f.Kind() == reflect.Array {
+				return f.Len()
+			}
+		}
+	}
+
+	return 0
+}
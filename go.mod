@@ -3,6 +3,7 @@ module github.com/fogfish/hnsw
 go 1.22.2
 
 require (
+	github.com/akrylysov/pogreb v0.10.2
 	github.com/bits-and-blooms/bitset v1.13.0
 	github.com/fogfish/faults v0.2.0
 	github.com/fogfish/guid/v2 v2.0.4
@@ -0,0 +1,113 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw/internal/pq"
+	"github.com/fogfish/hnsw/internal/types"
+)
+
+// drain queue of vertices (furthest first) into nearest-first sequence
+func drain(w pq.Queue[types.Vertex]) []types.Vertex {
+	seq := make([]types.Vertex, w.Len())
+	for i := w.Len() - 1; i >= 0; i-- {
+		seq[i] = w.Deq()
+	}
+	return seq
+}
+
+// select up to M neighbors for the base vector among candidates, sorted
+// nearest-first. Either M nearest candidates or diversity heuristic is used
+// depending on the configuration. Excluded nodes are never selected.
+func (h *HNSW[Vector]) selectNeighbors(level int, base Vector, candidates []types.Vertex, M int, exclude ...Pointer) []Pointer {
+	if !h.config.heuristic {
+		conns := make([]Pointer, 0, min(M, len(candidates)))
+		for _, c := range candidates[:min(M, len(candidates))] {
+			conns = append(conns, c.Addr)
+		}
+		return conns
+	}
+
+	return h.selectHeuristic(level, base, candidates, M, exclude)
+}
+
+// The heuristic (Algorithm 4) selects candidate only if it is closer to the
+// base than to any of already selected neighbors. It creates connections in
+// diverse directions, keeping clusters of data connected.
+func (h *HNSW[Vector]) selectHeuristic(level int, base Vector, candidates []types.Vertex, M int, exclude []Pointer) []Pointer {
+	w := pq.New(types.OrdForwardVertex, candidates...)
+
+	if h.config.extendCandidates {
+		var seen bitset.BitSet
+		for _, e := range exclude {
+			seen.Set(uint(e))
+		}
+		for _, c := range candidates {
+			seen.Set(uint(c.Addr))
+		}
+
+		for _, c := range candidates {
+			cnode := h.node(c.Addr)
+
+			if len(cnode.Connections) <= level {
+				continue
+			}
+
+			for _, e := range cnode.Connections[level] {
+				if seen.Test(uint(e)) || h.deleted(e) {
+					continue
+				}
+				seen.Set(uint(e))
+
+				ev, ok := h.load(e)
+				if !ok {
+					continue
+				}
+
+				dist := h.surface.Distance(base, ev)
+				w.Enq(types.Vertex{Distance: dist, Addr: e})
+			}
+		}
+	}
+
+	conns := make([]Pointer, 0, M)
+	pruned := make([]Pointer, 0)
+
+	for w.Len() > 0 && len(conns) < M {
+		c := w.Deq()
+		v, ok := h.load(c.Addr)
+		if !ok {
+			continue
+		}
+
+		diverse := true
+		for _, r := range conns {
+			rv, ok := h.load(r)
+			if ok && h.surface.Distance(v, rv) < c.Distance {
+				diverse = false
+				break
+			}
+		}
+
+		if diverse {
+			conns = append(conns, c.Addr)
+		} else {
+			pruned = append(pruned, c.Addr)
+		}
+	}
+
+	if h.config.keepPrunedConnections {
+		for i := 0; i < len(pruned) && len(conns) < M; i++ {
+			conns = append(conns, pruned[i])
+		}
+	}
+
+	return conns
+}
@@ -10,8 +10,11 @@ package hnsw
 
 import (
 	"fmt"
+	"slices"
 	"sync"
+	"time"
 
+	"github.com/bits-and-blooms/bitset"
 	"github.com/kshard/vector"
 )
 
@@ -25,6 +28,15 @@ type Pointer = uint32
 type Node[Vector any] struct {
 	Vector      Vector
 	Connections [][]Pointer
+	Deleted     bool
+}
+
+// Neighbor found by search, the vector is annotated with the distance to
+// query and the address of node.
+type Neighbor[Vector any] struct {
+	Vector   Vector
+	Distance float32
+	Pointer  Pointer
 }
 
 // Collection of serializable Hierarchical Navigable Small World Graph Nodes
@@ -36,15 +48,28 @@ type Nodes[Vector any] struct {
 
 // Hierarchical Navigable Small World Graph
 type HNSW[Vector any] struct {
-	rwCore sync.RWMutex
-	rwHeap [heapRWSlots]sync.RWMutex
+	// compaction remaps pointers, operations retaining pointers share the lock
+	rwCompact sync.RWMutex
+	rwCore    sync.RWMutex
+	rwHeap    [heapRWSlots]sync.RWMutex
+	rwRandom  sync.Mutex
 
 	config  Config
 	surface vector.Surface[Vector]
+	codec   Codec[Vector]
+
+	heap    []Node[Vector]
+	head    Pointer
+	level   int
+	created time.Time
+
+	// nodes changed since the last checkpoint
+	rwDirty  sync.Mutex
+	dirty    bitset.BitSet
+	dirtyAll bool
 
-	heap  []Node[Vector]
-	head  Pointer
-	level int
+	// disk-resident vectors
+	lazy *lazy[Vector]
 }
 
 // Creates Hierarchical Navigable Small World Graph
@@ -61,11 +86,14 @@ func New[Vector any](
 	hnsw := &HNSW[Vector]{
 		config:  config,
 		surface: surface,
+		codec:   codecOf[Vector](config.codec),
 	}
 
 	hnsw.level = 0
 	hnsw.heap = []Node[Vector]{}
 	hnsw.head = 0
+	hnsw.created = time.Now()
+	hnsw.dirtyAll = true
 
 	return hnsw
 }
@@ -85,11 +113,14 @@ func FromNodes[Vector any](
 	hnsw := &HNSW[Vector]{
 		config:  config,
 		surface: surface,
+		codec:   codecOf[Vector](config.codec),
 	}
 
 	hnsw.level = nodes.Rank
 	hnsw.heap = nodes.Heap
 	hnsw.head = nodes.Head
+	hnsw.created = time.Now()
+	hnsw.dirtyAll = true
 
 	return hnsw
 }
@@ -100,22 +131,112 @@ func (h *HNSW[Vector]) String() string {
 }
 
 // Return data structure nodes as serializable container.
+// Disk-resident vectors (see ReadLazy) are loaded into the container, vectors
+// failed to fetch are left empty and the error is reported by Err.
 func (h *HNSW[Vector]) Nodes() Nodes[Vector] {
+	heap := h.heap
+	if h.lazy != nil {
+		heap = make([]Node[Vector], len(h.heap))
+		for addr, node := range h.heap {
+			node.Vector = h.vector(Pointer(addr))
+			heap[addr] = node
+		}
+	}
+
 	return Nodes[Vector]{
 		Rank: h.level,
 		Head: h.head,
-		Heap: h.heap,
+		Heap: heap,
 	}
 }
 
+// node at the address, it is safe for concurrent use with inserts. The node
+// shares edges with the heap, they are replaced but never modified
+// in-place. The caller must not hold locks of the heap.
+func (h *HNSW[Vector]) node(addr Pointer) Node[Vector] {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	slot := addr % heapRWSlots
+	h.rwHeap[slot].RLock()
+	defer h.rwHeap[slot].RUnlock()
+
+	node := h.heap[addr]
+	node.Connections = slices.Clone(node.Connections)
+	return node
+}
+
+// deleted status of the node at the address, it is safe for concurrent use
+// with deletes. The caller must not hold locks of the heap.
+func (h *HNSW[Vector]) deleted(addr Pointer) bool {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	slot := addr % heapRWSlots
+	h.rwHeap[slot].RLock()
+	defer h.rwHeap[slot].RUnlock()
+
+	return h.heap[addr].Deleted
+}
+
+// links of the node at the level, it is safe for concurrent use with inserts.
+// The caller must not hold locks of the heap.
+func (h *HNSW[Vector]) links(addr Pointer, level int) []Pointer {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	slot := addr % heapRWSlots
+	h.rwHeap[slot].RLock()
+	defer h.rwHeap[slot].RUnlock()
+
+	return h.heap[addr].Connections[level]
+}
+
+// update node at the address, it is safe for concurrent use with inserts.
+// The caller must not hold locks of the heap.
+func (h *HNSW[Vector]) update(addr Pointer, f func(*Node[Vector])) {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	slot := addr % heapRWSlots
+	h.rwHeap[slot].Lock()
+	defer h.rwHeap[slot].Unlock()
+
+	f(&h.heap[addr])
+}
+
+// mark node as changed since the last checkpoint
+func (h *HNSW[Vector]) touch(addr Pointer) {
+	h.rwDirty.Lock()
+	h.dirty.Set(uint(addr))
+	h.rwDirty.Unlock()
+}
+
 // Return current head (entry point)
-func (h *HNSW[Vector]) Head() Vector { return h.heap[h.head].Vector }
+func (h *HNSW[Vector]) Head() Vector {
+	h.rwCore.RLock()
+	head := h.head
+	h.rwCore.RUnlock()
+
+	return h.vector(head)
+}
 
 // Return current level
-func (h *HNSW[Vector]) Level() int { return h.level }
+func (h *HNSW[Vector]) Level() int {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
 
-// Return number of vectors in the data structure
-func (h *HNSW[Vector]) Size() int { return len(h.heap) }
+	return h.level
+}
+
+// Return number of vectors in the data structure, including deleted ones
+// until the heap is compacted.
+func (h *HNSW[Vector]) Size() int {
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	return len(h.heap)
+}
 
 // Calculate distance between two vectors using defined surface distance function.
 //
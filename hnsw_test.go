@@ -9,11 +9,26 @@
 package hnsw_test
 
 import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
 	"math/rand"
+	"os"
+	"path/filepath"
+	"slices"
+	"sync"
+	"sync/atomic"
 	"testing"
 
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/guid/v2"
 	"github.com/fogfish/hnsw"
 	"github.com/fogfish/hnsw/vector"
+	"github.com/kelindar/binary"
 	surface "github.com/kshard/vector"
 )
 
@@ -54,6 +69,1383 @@ func TestInsert(t *testing.T) {
 	}
 }
 
+func TestSearchWithDistance(t *testing.T) {
+	for _, df := range []surface.Surface[surface.F32]{
+		surface.Euclidean(),
+		surface.Cosine(),
+	} {
+		index := sut(df)
+		for i, v := range vectors {
+			index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+		}
+
+		for _, q := range nodes(index)[:100] {
+			seq := index.SearchWithDistance(q, 10, 100)
+			if len(seq) != 10 || seq[0].Vector.Key != q.Key || seq[0].Distance > 1e-5 {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+
+			for i, x := range seq {
+				if x.Distance != index.Distance(q, x.Vector) {
+					t.Errorf("Invalid distance %v", x)
+				}
+
+				if i > 0 && seq[i-1].Distance > x.Distance {
+					t.Errorf("Not sorted %v", seq)
+				}
+			}
+		}
+	}
+}
+
+func TestSearchWithFilter(t *testing.T) {
+	for _, df := range []surface.Surface[surface.F32]{
+		surface.Euclidean(),
+		surface.Cosine(),
+	} {
+		index := sut(df)
+		for i, v := range vectors {
+			index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+		}
+
+		// Graph traversal
+		tenant := func(v vector.VF32) bool { return v.Key%10 == 0 }
+		for _, q := range nodes(index)[:100] {
+			seq := index.SearchWithFilter(q, 5, 100, tenant)
+			if len(seq) != 5 {
+				t.Errorf("Not enough results %v", seq)
+			}
+
+			for _, x := range seq {
+				if !tenant(x.Vector) {
+					t.Errorf("Not filtered %v", x)
+				}
+			}
+
+			if tenant(q) && seq[0].Vector.Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+
+		// Brute force
+		q := vector.VF32{Key: 5, Vec: vectors[5]}
+		seq := index.SearchWithFilter(q, 5, 100, func(v vector.VF32) bool { return v.Key == 5 })
+		if len(seq) != 1 || seq[0].Vector.Key != 5 {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+
+		allowed := bitset.New(n)
+		for _, x := range index.SearchWithDistance(q, 5, 100) {
+			allowed.Set(uint(x.Pointer))
+		}
+
+		seq = index.SearchWithin(q, 10, 100, allowed)
+		if len(seq) != 5 || seq[0].Vector.Key != 5 {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+}
+
+func TestSearchRadius(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	for _, q := range nodes(index)[:100] {
+		knn := index.SearchWithDistance(q, 20, 100)
+		r := knn[9].Distance
+
+		seq := index.SearchRadius(q, r, 100, 0)
+		if len(seq) < 10 || seq[0].Vector.Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+
+		for _, x := range seq {
+			if x.Distance > r {
+				t.Errorf("Outside of radius %v", x)
+			}
+		}
+
+		if seq := index.SearchRadius(q, r, 100, 3); len(seq) != 3 {
+			t.Errorf("Not limited %v", seq)
+		}
+	}
+}
+
+func TestHeuristic(t *testing.T) {
+	for _, opt := range []hnsw.Option{
+		hnsw.WithHeuristic(),
+		hnsw.WithExtendCandidates(),
+		hnsw.WithKeepPrunedConnections(),
+	} {
+		index := hnsw.New(
+			vector.SurfaceVF32(surface.Euclidean()),
+			hnsw.WithRandomSource(rnd),
+			hnsw.WithM0(64),
+			opt,
+		)
+		for i, v := range vectors {
+			index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+		}
+
+		if len(nodes(index)) != n {
+			t.Errorf("Graph is disconnected")
+		}
+
+		for _, q := range nodes(index) {
+			seq := index.Search(q, 1, 100)
+			if seq[0].Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+	}
+}
+
+func TestKeyed(t *testing.T) {
+	key := func(v vector.VF32) uint32 { return v.Key }
+	index := hnsw.NewKeyed(
+		vector.SurfaceVF32(surface.Euclidean()),
+		key,
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	// Upsert: changed vector is relinked
+	q := vector.VF32{Key: 5, Vec: rndVector()}
+	index.Upsert(q)
+	if v, has := index.Get(5); !has || index.Distance(v, q) != 0 {
+		t.Errorf("Not updated %v", v)
+	}
+
+	if seq := index.Search(q, 1, 100); seq[0].Key != 5 {
+		t.Errorf("Not found %v in %v", q, seq)
+	}
+
+	if seq := index.Search(vector.VF32{Vec: vectors[5]}, 1, 100); seq[0].Key == 5 {
+		t.Errorf("Old vector is found %v", seq)
+	}
+
+	// Concurrent upsert of the key keeps single node
+	var wg sync.WaitGroup
+	for _, v := range vectors[:8] {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			index.Upsert(vector.VF32{Key: 3, Vec: v})
+		}()
+	}
+	wg.Wait()
+
+	if len(nodes(index.HNSW)) != n {
+		t.Errorf("Duplicate nodes %d", len(nodes(index.HNSW)))
+	}
+
+	// Insert within the context maintains keys
+	for range 2 {
+		if err := index.InsertContext(context.Background(), vector.VF32{Key: n, Vec: rndVector()}); err != nil || !index.Has(n) {
+			t.Errorf("Not inserted %v", err)
+		}
+	}
+
+	if len(nodes(index.HNSW)) != n+1 {
+		t.Errorf("Duplicate nodes %d", len(nodes(index.HNSW)))
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := index.InsertContext(ctx, vector.VF32{Key: n, Vec: rndVector()}); err != context.Canceled || !index.Has(n) {
+		t.Errorf("Upsert is not cancelled %v", err)
+	}
+	index.DeleteKey(n)
+
+	// Delete
+	if !index.DeleteKey(7) || index.Has(7) || index.DeleteKey(7) {
+		t.Errorf("Not deleted")
+	}
+
+	// Compact remaps keys
+	index.Compact(func(v vector.VF32) bool { return v.Key != 9 })
+	if index.Has(9) || index.Size() != n-2 {
+		t.Errorf("Not compacted")
+	}
+
+	// Persistence
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	clone := hnsw.NewKeyed(vector.SurfaceVF32(surface.Euclidean()), key)
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	for i := 0; i < n; i++ {
+		v, has := clone.Get(uint32(i))
+		switch {
+		case i == 7 || i == 9:
+			if has {
+				t.Errorf("Deleted %v is found", v)
+			}
+		case !has || v.Key != uint32(i):
+			t.Errorf("Not found %v", i)
+		}
+	}
+
+	// Read swaps the index, which is concurrently searched
+	small := hnsw.NewKeyed(vector.SurfaceVF32(surface.Euclidean()), key)
+	for i, v := range vectors[:10] {
+		small.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	other := kv{}
+	if err := small.Write(other); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 10; i++ {
+			clone.Read(other)
+			clone.Read(store)
+		}
+	}()
+	for i := 0; i < 100; i++ {
+		clone.Search(vector.VF32{Vec: vectors[i]}, 5, 100)
+	}
+	wg.Wait()
+
+	// Delta of keys
+	u := vector.VF32{Key: 11, Vec: rndVector()}
+	index.Upsert(u)
+	index.DeleteKey(13)
+	if err := index.WriteDelta(store); err != nil {
+		t.Errorf("WriteDelta failed %v", err)
+	}
+
+	index.DeleteKey(15)
+	if err := index.WriteDelta(store); err != nil {
+		t.Errorf("WriteDelta failed %v", err)
+	}
+
+	if delta := store["&keymap\x01\x00\x00\x00"]; len(delta) == 0 || len(delta) >= len(store["&keymap"]) {
+		t.Errorf("Unexpected delta of keys %d", len(delta))
+	}
+
+	clone = hnsw.NewKeyed(vector.SurfaceVF32(surface.Euclidean()), key)
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	if v, has := clone.Get(11); !has || clone.Distance(v, u) != 0 {
+		t.Errorf("Not updated %v", v)
+	}
+
+	if clone.Has(13) || clone.Has(15) || !clone.Has(17) {
+		t.Errorf("Keys are not merged")
+	}
+
+	// Snapshot
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo failed %v", err)
+	}
+
+	clone = hnsw.NewKeyed(vector.SurfaceVF32(surface.Euclidean()), key)
+	if _, err := clone.ReadFrom(&buf); err != nil {
+		t.Errorf("ReadFrom failed %v", err)
+	}
+
+	if v, has := clone.Get(5); !has || clone.Distance(v, q) != 0 {
+		t.Errorf("Not found %v", v)
+	}
+
+	if clone.Has(7) || clone.Has(9) || !clone.DeleteKey(11) || clone.Has(11) {
+		t.Errorf("Keys are not rebuilt")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	index := sut(surface.Euclidean())
+
+	progress := atomic.Int64{}
+	pipe := index.PipeContext(context.Background(), 4,
+		func(n int) { progress.Add(1) },
+	)
+	for i, v := range vectors {
+		if err := pipe.Send(vector.VF32{Key: uint32(i), Vec: v}); err != nil {
+			t.Errorf("Send failed %v", err)
+		}
+	}
+
+	if err := pipe.Close(); err != nil {
+		t.Errorf("Close failed %v", err)
+	}
+
+	if index.Size() != n || pipe.Inserted() != n || progress.Load() != n {
+		t.Errorf("Not inserted %d", index.Size())
+	}
+
+	if err := pipe.Send(vector.VF32{Vec: vectors[0]}); err != hnsw.ErrClosed {
+		t.Errorf("Send to closed pipe %v", err)
+	}
+
+	// Cancellation
+	ctx, cancel := context.WithCancel(context.Background())
+	pipe = sut(surface.Euclidean()).PipeContext(ctx, 4, nil)
+	cancel()
+	pipe.Wait()
+
+	if err := pipe.Send(vector.VF32{Vec: vectors[0]}); err != context.Canceled {
+		t.Errorf("Send to cancelled pipe %v", err)
+	}
+
+	if err := pipe.Close(); err != nil {
+		t.Errorf("Close of cancelled pipe without pending vectors %v", err)
+	}
+
+	// Cancellation discards pending vectors
+	ready := make(chan struct{})
+	ctx, cancel = context.WithCancel(context.Background())
+	pipe = sut(surface.Euclidean()).PipeContext(ctx, 1,
+		func(n int) { <-ready },
+	)
+	for _, v := range vectors[:2] {
+		if err := pipe.Send(vector.VF32{Vec: v}); err != nil {
+			t.Errorf("Send failed %v", err)
+		}
+	}
+	cancel()
+	close(ready)
+
+	if err := pipe.Close(); err != context.Canceled || pipe.Inserted() != 1 {
+		t.Errorf("Close of cancelled pipe %v, inserted %d", err, pipe.Inserted())
+	}
+}
+
+func TestContext(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors {
+		if err := index.InsertContext(context.Background(), vector.VF32{Key: uint32(i), Vec: v}); err != nil {
+			t.Errorf("Insert failed %v", err)
+		}
+	}
+
+	q := vector.VF32{Key: 5, Vec: vectors[5]}
+	seq, err := index.SearchContext(context.Background(), q, 1, 100)
+	if err != nil || seq[0].Key != q.Key {
+		t.Errorf("Not found %v in %v (%v)", q, seq, err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	if _, err := index.SearchContext(ctx, q, 1, 100); err != context.Canceled {
+		t.Errorf("Search is not cancelled %v", err)
+	}
+
+	if err := index.InsertContext(ctx, vector.VF32{Key: n, Vec: rndVector()}); err != context.Canceled || index.Size() != n {
+		t.Errorf("Insert is not cancelled %v", err)
+	}
+
+	// Search is cancelled while the layer is traversed, results found
+	// so far are returned
+	calls, cancelAt := 0, 0
+	slow := hnsw.New(
+		vector.SurfaceVF32(hooked{surface.Euclidean(), func() {
+			calls++
+			if calls == cancelAt {
+				cancel()
+			}
+		}}),
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		slow.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	calls = 0
+	if seq, err := slow.SearchContext(context.Background(), q, 10, 100); err != nil || len(seq) != 10 {
+		t.Errorf("Search failed %v (%v)", seq, err)
+	}
+
+	full := calls
+	calls, cancelAt = 0, full/2
+	ctx, cancel = context.WithCancel(context.Background())
+	defer cancel()
+
+	seq, err = slow.SearchContext(ctx, q, 10, 100)
+	if err != context.Canceled || len(seq) == 0 || calls >= full {
+		t.Errorf("Search is not cancelled %v (%v) after %d of %d distances", seq, err, calls, full)
+	}
+}
+
+// surface, which calls the hook on each distance computation
+type hooked struct {
+	surface.Surface[surface.F32]
+	hook func()
+}
+
+func (s hooked) Distance(a, b surface.F32) float32 {
+	s.hook()
+	return s.Surface.Distance(a, b)
+}
+
+func TestWriteTo(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+	index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+
+	var buf bytes.Buffer
+	wn, err := index.WriteTo(&buf)
+	if err != nil || wn != int64(buf.Len()) {
+		t.Errorf("WriteTo failed %v", err)
+	}
+	snapshot := buf.Bytes()
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	rn, err := clone.ReadFrom(bytes.NewReader(snapshot))
+	if err != nil || rn != wn {
+		t.Errorf("ReadFrom failed %v", err)
+	}
+
+	if clone.Size() != n || clone.Level() != index.Level() || len(nodes(clone)) != n-1 {
+		t.Errorf("Not equal %s and %s", clone, index)
+	}
+
+	for _, q := range nodes(index) {
+		seq := clone.Search(q, 1, 100)
+		if seq[0].Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+
+	// Corruption
+	snapshot[len(snapshot)/2] ^= 0xff
+	if _, err := clone.ReadFrom(bytes.NewReader(snapshot)); err == nil {
+		t.Errorf("Corruption is not detected")
+	}
+
+	if _, err := clone.ReadFrom(bytes.NewReader(snapshot[:len(snapshot)/2])); err == nil {
+		t.Errorf("Truncation is not detected")
+	}
+
+	// head and level shall address the node of the heap
+	snapshot[len(snapshot)/2] ^= 0xff
+	for _, f := range []func(*header){
+		func(h *header) { h.Head = uint32(h.Size) },
+		func(h *header) { h.Level++ },
+	} {
+		if _, err := clone.ReadFrom(bytes.NewReader(reheader(t, snapshot, f))); !errors.Is(err, hnsw.ErrCorrupted) {
+			t.Errorf("Invalid head or level is not detected %v", err)
+		}
+	}
+
+	// header length is limited
+	binary.LittleEndian.PutUint32(snapshot[8:], math.MaxUint32)
+	if _, err := clone.ReadFrom(bytes.NewReader(snapshot)); err == nil {
+		t.Errorf("Invalid header length is not detected")
+	}
+}
+
+// header of the snapshot
+type header struct {
+	EfConstruction int
+	MLayerN        int
+	MLayer0        int
+	ML             float64
+	Size           int
+	Head           uint32
+	Level          int
+	Dimension      int
+	Surface        string
+	Vector         string
+	Codec          string
+	Created        int64
+}
+
+// rewrites header of the snapshot, the checksum of the section is updated
+func reheader(t *testing.T, snapshot []byte, f func(*header)) []byte {
+	t.Helper()
+
+	size := int(binary.LittleEndian.Uint32(snapshot[8:]))
+	tail := snapshot[12+size+4:]
+
+	var h header
+	if err := binary.Unmarshal(snapshot[12:12+size], &h); err != nil {
+		t.Fatalf("Unmarshal failed %v", err)
+	}
+	f(&h)
+
+	b, err := binary.Marshal(h)
+	if err != nil {
+		t.Fatalf("Marshal failed %v", err)
+	}
+
+	out := slices.Clone(snapshot[:8])
+	out = binary.LittleEndian.AppendUint32(out, uint32(len(b)))
+	out = append(out, b...)
+	out = binary.LittleEndian.AppendUint32(out, crc32.Checksum(out, crc32.MakeTable(crc32.Castagnoli)))
+	return append(out, tail...)
+}
+
+func TestCodec(t *testing.T) {
+	codec := hnsw.WithCodec[vector.VF32](vector.CodecVF32{})
+	index := hnsw.New(vector.SurfaceVF32(surface.Euclidean()),
+		hnsw.WithRandomSource(rnd),
+		codec,
+	)
+	for i, v := range vectors[:n/2] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+	index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo failed %v", err)
+	}
+
+	for _, read := range []func(*hnsw.HNSW[vector.VF32]) error{
+		func(h *hnsw.HNSW[vector.VF32]) error { return h.Read(store) },
+		func(h *hnsw.HNSW[vector.VF32]) error { return h.ReadLazy(store, 64) },
+		func(h *hnsw.HNSW[vector.VF32]) error {
+			_, err := h.ReadFrom(bytes.NewReader(buf.Bytes()))
+			return err
+		},
+	} {
+		clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()), codec)
+		if err := read(clone); err != nil {
+			t.Errorf("Read failed %v", err)
+		}
+
+		if clone.Size() != index.Size() || len(nodes(clone)) != n/2-1 {
+			t.Errorf("Not equal %s and %s", clone, index)
+		}
+
+		for _, q := range nodes(index) {
+			seq := clone.Search(q, 1, 100)
+			if seq[0].Key != q.Key || !equal(seq[0].Vec, q.Vec) {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+	}
+
+	k := vector.KF32{Key: guid.G(guid.Clock), Vec: vectors[0]}
+	b, _ := vector.CodecKF32{}.Encode(k)
+	if v, err := (vector.CodecKF32{}).Decode(b); err != nil || v.Key != k.Key || !equal(v.Vec, k.Vec) {
+		t.Errorf("Not equal %v and %v", v, k)
+	}
+
+	// Codec does not support vector type
+	defer func() {
+		if recover() == nil {
+			t.Errorf("Codec of invalid type is accepted")
+		}
+	}()
+	hnsw.New(vector.SurfaceKF32(surface.Euclidean()), codec)
+}
+
+func TestFormat(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors[:n/4] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	// Incompatible reader
+	for _, clone := range []interface{ Read(hnsw.Reader) error }{
+		hnsw.New(vector.SurfaceVF32(surface.Cosine())),
+		hnsw.New(vector.SurfaceVF32(surface.Euclidean()), hnsw.WithCodec[vector.VF32](vector.CodecVF32{})),
+		hnsw.New(vector.SurfaceKF32(surface.Euclidean())),
+	} {
+		if err := clone.Read(store); err == nil {
+			t.Errorf("Incompatible index is read")
+		}
+	}
+
+	// Migration rebuilds index
+	var meta hnsw.Metadata
+	clone := hnsw.New(vector.SurfaceVF32(surface.Cosine()),
+		hnsw.WithMigration(
+			func(m hnsw.Metadata, r hnsw.Reader) (hnsw.Reader, error) {
+				meta = m
+
+				old := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+				if err := old.Read(r); err != nil {
+					return nil, err
+				}
+
+				idx := hnsw.New(vector.SurfaceVF32(surface.Cosine()))
+				for _, v := range nodes(old) {
+					idx.Insert(v)
+				}
+
+				upgraded := kv{}
+				return upgraded, idx.Write(upgraded)
+			},
+		),
+	)
+	if err := clone.Read(store); err != nil || clone.Size() != n/4 {
+		t.Errorf("Migration failed %v", err)
+	}
+
+	if meta.Version != 2 || meta.Dimension != d || meta.Surface != "Euclidean" || meta.Vector != "vector.VF32" || meta.Codec != "" || meta.Created.IsZero() {
+		t.Errorf("Unexpected metadata %+v", meta)
+	}
+
+	// Legacy layout
+	var legacy struct {
+		EfConstruction int
+		MLayerN        int
+		MLayer0        int
+		ML             float64
+		Size           int
+		Head           uint32
+		Level          int
+	}
+	root := store["&root"]
+	if err := binary.Unmarshal(root[8:], &legacy); err != nil {
+		t.Errorf("Unmarshal failed %v", err)
+	}
+	b, _ := binary.Marshal(legacy)
+	legacyStore := kv{"&root": b}
+	for addr, node := range index.Nodes().Heap {
+		b, _ := binary.Marshal(struct {
+			Vector      vector.VF32
+			Connections [][]uint32
+		}{node.Vector, node.Connections})
+		legacyStore[string(binary.LittleEndian.AppendUint32([]byte("&"), uint32(addr)))] = b
+	}
+
+	other := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := other.Read(legacyStore); err != nil || other.Size() != n/4 {
+		t.Errorf("Legacy layout is not read %v", err)
+	}
+
+	for _, q := range nodes(index)[:10] {
+		if seq := other.Search(q, 1, 100); seq[0].Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+
+	// Unsupported version
+	root[4] = 9
+	store["&root"] = root
+	if err := other.Read(store); err == nil {
+		t.Errorf("Unsupported version is read")
+	}
+}
+
+func TestVerify(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors[:n/4] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	if report, err := index.Verify(store); err != nil || !report.OK() || report.Size != n/4 {
+		t.Errorf("Verify failed %v %v", report, err)
+	}
+
+	// Corrupted and missing nodes
+	corrupted := kv{}
+	for key, val := range store {
+		corrupted[key] = bytes.Clone(val)
+	}
+	corrupted[string([]byte{'&', 3, 0, 0, 0})][10] ^= 0xff
+	delete(corrupted, string([]byte{'&', 7, 0, 0, 0}))
+
+	report, err := index.Verify(corrupted)
+	if err != nil || report.OK() || len(report.Corrupted) != 1 || report.Corrupted[0] != 3 || len(report.Missing) != 1 || report.Missing[0] != 7 {
+		t.Errorf("Unexpected report %v %v", report, err)
+	}
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := clone.Read(corrupted); !errors.Is(err, hnsw.ErrCorrupted) || clone.Size() != 0 {
+		t.Errorf("Corruption is not detected %v", err)
+	}
+
+	// Dangling pointers, header of smaller index
+	small := sut(surface.Euclidean())
+	for i, v := range vectors[:10] {
+		small.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	header := kv{}
+	if err := small.Write(header); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+	store["&root"] = header["&root"]
+
+	report, err = index.Verify(store)
+	if err != nil || report.OK() || len(report.Dangling) == 0 {
+		t.Errorf("Unexpected report %v %v", report, err)
+	}
+
+	if err := clone.Read(store); !errors.Is(err, hnsw.ErrCorrupted) {
+		t.Errorf("Dangling pointers are not detected %v", err)
+	}
+}
+
+func TestWriteDelta(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors[:n/2] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	for i, v := range vectors[n/2 : n/2+10] {
+		index.Insert(vector.VF32{Key: uint32(n/2 + i), Vec: v})
+	}
+	index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+
+	delta := kv{}
+	if err := index.WriteDelta(delta); err != nil {
+		t.Errorf("WriteDelta failed %v", err)
+	}
+
+	if _, has := delta["&root"]; !has || len(delta) < 12 || len(delta) > n/2 {
+		t.Errorf("Unexpected delta of %d keys", len(delta))
+	}
+
+	for key, val := range delta {
+		store[key] = val
+	}
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	if clone.Size() != index.Size() || len(nodes(clone)) != n/2+9 {
+		t.Errorf("Not equal %s and %s", clone, index)
+	}
+
+	for _, q := range nodes(index) {
+		seq := clone.Search(q, 1, 100)
+		if seq[0].Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+
+	// Nothing is changed since the last checkpoint
+	empty := kv{}
+	if err := index.WriteDelta(empty); err != nil || len(empty) != 1 {
+		t.Errorf("Unexpected delta of %d keys", len(empty))
+	}
+}
+
+func TestWAL(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "hnsw.wal")
+
+	wal, err := hnsw.OpenWAL(file, 0)
+	if err != nil {
+		t.Fatalf("OpenWAL failed %v", err)
+	}
+
+	index := hnsw.New(vector.SurfaceVF32(surface.Euclidean()), hnsw.WithWAL(wal))
+	for i, v := range vectors[:n/2] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	for i, v := range vectors[n/2 : n/2+10] {
+		index.Insert(vector.VF32{Key: uint32(n/2 + i), Vec: v})
+	}
+	index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+
+	if err := wal.Close(); err != nil {
+		t.Errorf("Close failed %v", err)
+	}
+
+	// Errors of closed log
+	failed := hnsw.New(vector.SurfaceVF32(surface.Euclidean()), hnsw.WithWAL(wal))
+	failed.Insert(vector.VF32{Key: 1, Vec: vectors[1]})
+	if wal.Err() == nil {
+		t.Errorf("Error is not reported")
+	}
+
+	if err := failed.InsertContext(context.Background(), vector.VF32{Key: 2, Vec: vectors[2]}); err == nil {
+		t.Errorf("Error is not returned")
+	}
+
+	// Torn tail
+	fd, _ := os.OpenFile(file, os.O_WRONLY|os.O_APPEND, 0644)
+	fd.Write([]byte{1, 0xff, 0xff})
+	fd.Close()
+
+	wal, err = hnsw.OpenWAL(file, -1)
+	if err != nil {
+		t.Fatalf("OpenWAL failed %v", err)
+	}
+	defer wal.Close()
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()), hnsw.WithWAL(wal))
+	if err := clone.Recover(store); err != nil {
+		t.Errorf("Recover failed %v", err)
+	}
+
+	if clone.Size() != index.Size() || len(nodes(clone)) != n/2+9 {
+		t.Errorf("Not equal %s and %s", clone, index)
+	}
+
+	for _, q := range nodes(index) {
+		seq := clone.Search(q, 1, 100)
+		if seq[0].Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+
+	if err := clone.WriteDelta(store); err != nil {
+		t.Errorf("WriteDelta failed %v", err)
+	}
+
+	if fi, err := os.Stat(file); err != nil || fi.Size() != 0 {
+		t.Errorf("Log is not truncated")
+	}
+
+	// Nodes dropped by compaction are logged
+	clone.Compact(func(v vector.VF32) bool { return v.Key >= 10 })
+
+	other := hnsw.New(vector.SurfaceVF32(surface.Euclidean()), hnsw.WithWAL(wal))
+	if err := other.Recover(store); err != nil {
+		t.Errorf("Recover failed %v", err)
+	}
+
+	for _, v := range nodes(other) {
+		if v.Key < 10 {
+			t.Errorf("Dropped %v is recovered", v.Key)
+		}
+	}
+
+	if len(nodes(other)) != len(nodes(clone)) {
+		t.Errorf("Not equal %s and %s", other, clone)
+	}
+}
+
+func TestScalarQuantization(t *testing.T) {
+	sq := vector.NewScalarQuantizer(vectors[:100])
+
+	store := kv{}
+	index := hnsw.New(
+		vector.SurfaceVI8(sq.Euclidean()),
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		index.Insert(sq.EncodeVF32(vector.VF32{Key: uint32(i), Vec: v}))
+		vector.PutVF32(store, vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	for i, q := range vectors[:100] {
+		seq, err := index.SearchRerank(vector.VI8{Vec: sq.Encode(q)}, 5, 100,
+			vector.RerankVI8(store, surface.Euclidean(), q),
+		)
+		if err != nil {
+			t.Errorf("SearchRerank failed %v", err)
+		}
+
+		if len(seq) != 5 || seq[0].Vector.Key != uint32(i) || seq[0].Distance != 0 {
+			t.Errorf("Not found %v in %v", i, seq)
+		}
+	}
+
+	clone := hnsw.New(vector.SurfaceVI8(sq.Euclidean()))
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	if seq := clone.Search(vector.VI8{Vec: sq.Encode(vectors[1])}, 1, 100); seq[0].Key != 1 {
+		t.Errorf("Not found %v in %v", 1, seq)
+	}
+}
+
+func TestProductQuantization(t *testing.T) {
+	pq, err := vector.NewProductQuantizer(vectors, 16, 64, rnd)
+	if err != nil {
+		t.Fatalf("NewProductQuantizer failed %v", err)
+	}
+
+	store := kv{}
+	index := hnsw.New(
+		vector.SurfaceVPQ(pq),
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		index.Insert(pq.EncodeVF32(vector.VF32{Key: uint32(i), Vec: v}))
+		vector.PutVF32(store, vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	found := 0
+	for i, q := range vectors[:100] {
+		seq, err := index.SearchRerank(pq.QueryVPQ(q), 5, 100,
+			vector.RerankVPQ(store, surface.Euclidean(), q),
+		)
+		if err != nil {
+			t.Errorf("SearchRerank failed %v", err)
+		}
+
+		if len(seq) == 5 && seq[0].Vector.Key == uint32(i) && seq[0].Distance == 0 {
+			found++
+		}
+	}
+
+	if found < 95 {
+		t.Errorf("Low recall %d", found)
+	}
+
+	// Codebooks are persisted with index
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	restored := &vector.ProductQuantizer{}
+	clone := hnsw.New(vector.SurfaceVPQ(restored))
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	if restored.M != pq.M || restored.K != pq.K || restored.Dim != pq.Dim {
+		t.Errorf("Not restored %v", restored)
+	}
+
+	if seq := clone.Search(restored.QueryVPQ(vectors[1]), 1, 100); seq[0].Key != pq.EncodeVF32(vector.VF32{Key: 1, Vec: vectors[1]}).Key {
+		t.Errorf("Not found %v in %v", 1, seq)
+	}
+
+	// Codebooks are persisted with snapshot
+	var buf bytes.Buffer
+	if _, err := index.WriteTo(&buf); err != nil {
+		t.Errorf("WriteTo failed %v", err)
+	}
+
+	restored = &vector.ProductQuantizer{}
+	clone = hnsw.New(vector.SurfaceVPQ(restored))
+	if _, err := clone.ReadFrom(&buf); err != nil {
+		t.Errorf("ReadFrom failed %v", err)
+	}
+
+	if seq := clone.Search(restored.QueryVPQ(vectors[1]), 1, 100); seq[0].Key != 1 {
+		t.Errorf("Not found %v in %v", 1, seq)
+	}
+
+	// Corrupted codebooks are rejected
+	type codebooks struct {
+		M, K, Dim int
+		Codebooks [][]float32
+	}
+	for _, c := range []codebooks{
+		{M: 0, K: 64, Dim: d},
+		{M: 3, K: 64, Dim: d, Codebooks: make([][]float32, 3)},
+		{M: 16, K: 0, Dim: d, Codebooks: make([][]float32, 16)},
+		{M: 16, K: 512, Dim: d, Codebooks: make([][]float32, 16)},
+		{M: 16, K: 64, Dim: d, Codebooks: make([][]float32, 15)},
+		{M: 16, K: 64, Dim: d, Codebooks: append(slices.Clone(pq.Codebooks[:15]), make([]float32, 7))},
+	} {
+		b, err := binary.Marshal(c)
+		if err != nil {
+			t.Fatalf("Marshal failed %v", err)
+		}
+
+		if err := (&vector.ProductQuantizer{}).UnmarshalBinary(b); !errors.Is(err, hnsw.ErrCorrupted) {
+			t.Errorf("Corrupted codebooks M=%d K=%d Dim=%d are not detected %v", c.M, c.K, c.Dim, err)
+		}
+	}
+}
+
+func TestBinaryQuantization(t *testing.T) {
+	store := kv{}
+	index := hnsw.New(
+		vector.SurfaceVBits(vector.Hamming()),
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		index.Insert(vector.BinaryVF32(vector.VF32{Key: uint32(i), Vec: v}))
+		vector.PutVF32(store, vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	for i, q := range vectors[:100] {
+		seq, err := index.SearchOversample(vector.VBits{Vec: vector.Binary(q)}, 5, 4, 100,
+			vector.RerankVBits(store, surface.Euclidean(), q),
+		)
+		if err != nil {
+			t.Errorf("SearchOversample failed %v", err)
+		}
+
+		if len(seq) != 5 || seq[0].Vector.Key != uint32(i) || seq[0].Distance != 0 {
+			t.Errorf("Not found %v in %v", i, seq)
+		}
+	}
+}
+
+func TestHalfPrecision(t *testing.T) {
+	for _, x := range []float32{0, 1, -2.5, 0.1, 65504, 1e-7} {
+		if f := vector.ToF16([]float32{x}).F32()[0]; math.Abs(float64(f-x)) > math.Abs(float64(x))/1000+6e-8 {
+			t.Errorf("Invalid float16 conversion %v to %v", x, f)
+		}
+		if f := vector.ToBF16([]float32{x}).F32()[0]; math.Abs(float64(f-x)) > math.Abs(float64(x))/100 {
+			t.Errorf("Invalid bfloat16 conversion %v to %v", x, f)
+		}
+	}
+
+	index := hnsw.New(
+		vector.SurfaceVF16(vector.EuclideanF16()),
+		hnsw.WithRandomSource(rnd),
+		hnsw.WithM0(64),
+	)
+	for i, v := range vectors {
+		index.Insert(vector.ToVF16(vector.VF32{Key: uint32(i), Vec: v}))
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	clone := hnsw.New(vector.SurfaceVF16(vector.EuclideanF16()))
+	if err := clone.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	for i, q := range vectors[:100] {
+		seq := clone.Search(vector.ToVF16(vector.VF32{Vec: q}), 1, 100)
+		if seq[0].Key != uint32(i) {
+			t.Errorf("Not found %v in %v", i, seq)
+		}
+	}
+}
+
+func TestCollisions(t *testing.T) {
+	sq := vector.NewScalarQuantizer(vectors[:100])
+	pq, err := vector.NewProductQuantizer(vectors, 16, 64, rnd)
+	if err != nil {
+		t.Fatalf("NewProductQuantizer failed %v", err)
+	}
+
+	// Same vectors of distinct keys share the code
+	duplicates := make([]vector.VF32, 0, 200)
+	for i, v := range vectors[:100] {
+		duplicates = append(duplicates,
+			vector.VF32{Key: uint32(i), Vec: v},
+			vector.VF32{Key: uint32(n + i), Vec: v},
+		)
+	}
+
+	// Distinct vectors share sign patterns of low dimension
+	lowdim := make([]vector.VF32, 0, n)
+	for i, v := range vectors {
+		lowdim = append(lowdim, vector.VF32{Key: uint32(i), Vec: v[:8]})
+	}
+
+	for _, tc := range []struct {
+		name string
+		test func(t *testing.T)
+	}{
+		{"ScalarQuantization", func(t *testing.T) {
+			collisions(t, vector.SurfaceVI8(sq.Euclidean()), sq.EncodeVF32, duplicates)
+		}},
+		{"ProductQuantization", func(t *testing.T) {
+			collisions(t, vector.SurfaceVPQ(pq), pq.EncodeVF32, duplicates)
+		}},
+		{"BinaryQuantization", func(t *testing.T) {
+			collisions(t, vector.SurfaceVBits(vector.Hamming()), vector.BinaryVF32, lowdim)
+		}},
+		{"HalfPrecision", func(t *testing.T) {
+			collisions(t, vector.SurfaceVF16(vector.EuclideanF16()), vector.ToVF16, duplicates)
+		}},
+	} {
+		t.Run(tc.name, tc.test)
+	}
+}
+
+// vectors of distinct keys are not lost if their encodings collide
+func collisions[V any](t *testing.T, surface surface.Surface[V], encode func(vector.VF32) V, seq []vector.VF32) {
+	t.Helper()
+
+	index := hnsw.New(surface, hnsw.WithRandomSource(rnd))
+	for _, v := range seq {
+		index.Insert(encode(v))
+	}
+
+	if index.Size() != len(seq) {
+		t.Errorf("Vectors are lost, size %d", index.Size())
+	}
+}
+
+func TestReadLazy(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors[:n/2] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	store := kv{}
+	if err := index.Write(store); err != nil {
+		t.Errorf("Write failed %v", err)
+	}
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := clone.ReadLazy(store, 64); err != nil {
+		t.Errorf("ReadLazy failed %v", err)
+	}
+
+	for _, q := range vectors[:10] {
+		a := index.SearchWithDistance(vector.VF32{Vec: q}, 5, 100)
+		b := clone.SearchWithDistance(vector.VF32{Vec: q}, 5, 100)
+		for i := range a {
+			if a[i].Vector.Key != b[i].Vector.Key || a[i].Distance != b[i].Distance {
+				t.Errorf("Not equal %v and %v", a, b)
+			}
+		}
+	}
+
+	// Inserted vectors are resident in memory
+	clone.Insert(vector.VF32{Key: n, Vec: vectors[n-1]})
+	if seq := clone.Search(vector.VF32{Vec: vectors[n-1]}, 1, 100); seq[0].Key != n {
+		t.Errorf("Not found %v in %v", n, seq)
+	}
+
+	if err := clone.WriteDelta(store); err != nil || clone.Err() != nil {
+		t.Errorf("WriteDelta failed %v", err)
+	}
+
+	other := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := other.Read(store); err != nil {
+		t.Errorf("Read failed %v", err)
+	}
+
+	if other.Size() != clone.Size() || len(nodes(other)) != n/2+1 {
+		t.Errorf("Not equal %s and %s", other, clone)
+	}
+
+	// Nodes, which vectors are lost, are skipped
+	broken := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := broken.ReadLazy(store, 64); err != nil {
+		t.Errorf("ReadLazy failed %v", err)
+	}
+
+	for i := 0; i < n/2; i += 2 {
+		key := binary.LittleEndian.AppendUint32([]byte("&"), uint32(i))
+		delete(store, string(key))
+	}
+
+	for _, q := range vectors[:10] {
+		if seq := broken.Search(vector.VF32{Vec: q}, 5, 100); len(seq) == 0 {
+			t.Errorf("Not found %v", q)
+		}
+	}
+
+	// Filters and radius search never observe vectors failed to fetch
+	lost := func(v vector.VF32) bool {
+		if len(v.Vec) == 0 {
+			t.Errorf("Lost vector is observed")
+		}
+		return true
+	}
+	for _, q := range vectors[:10] {
+		broken.SearchWithFilter(vector.VF32{Vec: q}, 5, 100, lost)
+		broken.SearchWithFilter(vector.VF32{Vec: q}, 5, 100, func(v vector.VF32) bool { return lost(v) && v.Key == 1 })
+
+		for _, x := range broken.SearchRadius(vector.VF32{Vec: q}, 10.0, 100, 0) {
+			lost(x.Vector)
+		}
+	}
+
+	if broken.Err() == nil {
+		t.Errorf("Error is not reported")
+	}
+
+	// Vectors failed to fetch are not persisted
+	if err := broken.Write(kv{}); err == nil {
+		t.Errorf("Write of lost vectors is not failed")
+	}
+
+	if _, err := broken.WriteTo(io.Discard); err == nil {
+		t.Errorf("WriteTo of lost vectors is not failed")
+	}
+}
+
+func TestBatch(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors[:n/2] {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	// Half-written index is not observable
+	store := &batchkv{kv: kv{}, fail: n / 4}
+	if err := index.Write(store); err == nil || len(store.kv) != 0 {
+		t.Errorf("Unexpected write of %d keys", len(store.kv))
+	}
+
+	store.fail = 0
+	if err := index.Write(store); err != nil || len(store.kv) != n/2+1 {
+		t.Errorf("Write failed %v", err)
+	}
+
+	for _, r := range []hnsw.Reader{
+		store,
+		struct{ hnsw.BatchReader }{store},
+	} {
+		clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+		if err := clone.Read(r); err != nil {
+			t.Errorf("Read failed %v", err)
+		}
+
+		if clone.Size() != index.Size() || len(nodes(clone)) != n/2 {
+			t.Errorf("Not equal %s and %s", clone, index)
+		}
+
+		for _, q := range nodes(index) {
+			seq := clone.Search(q, 1, 100)
+			if seq[0].Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+	}
+
+	lazy := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := lazy.ReadLazy(struct{ hnsw.BatchReader }{store}, 64); err != nil {
+		t.Errorf("ReadLazy failed %v", err)
+	}
+
+	for _, q := range vectors[:10] {
+		a := index.Search(vector.VF32{Vec: q}, 5, 100)
+		b := lazy.Search(vector.VF32{Vec: q}, 5, 100)
+		for i := range a {
+			if a[i].Key != b[i].Key {
+				t.Errorf("Not equal %v and %v", a, b)
+			}
+		}
+	}
+
+	if err := lazy.Err(); err != nil {
+		t.Errorf("Fetch failed %v", err)
+	}
+}
+
+func TestStats(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	stats := index.Stats()
+	if stats.Size != n || stats.Deleted != 0 || stats.Isolated != 0 || len(stats.Levels) != index.Level() {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	for lvl, l := range stats.Levels {
+		if l.Unreachable != 0 || l.Saturated < 0 || l.Saturated > 1 {
+			t.Errorf("Unexpected stats of level %d %v", lvl, l)
+		}
+
+		nodes, in, out := 0, 0, 0
+		for d, c := range l.OutDegree {
+			nodes += c
+			out += d * c
+		}
+		for d, c := range l.InDegree {
+			in += d * c
+		}
+
+		if nodes != l.Nodes || in != out {
+			t.Errorf("Unexpected degree of level %d %v", lvl, l)
+		}
+	}
+
+	if stats.Levels[0].Nodes != n {
+		t.Errorf("Unexpected number of nodes %v", stats.Levels[0])
+	}
+
+	index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+	if stats := index.Stats(); stats.Deleted != 1 || stats.Levels[0].Nodes != n-1 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+}
+
+func TestRepair(t *testing.T) {
+	index := sut(surface.Euclidean())
+	for i, v := range vectors {
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	// disconnect nodes at level 0
+	nodes := index.Nodes()
+	orphans := []hnsw.Pointer{}
+	for addr, node := range nodes.Heap {
+		if len(orphans) < 5 && len(node.Connections) == 1 && hnsw.Pointer(addr) != nodes.Head {
+			orphans = append(orphans, hnsw.Pointer(addr))
+		}
+	}
+
+	for addr, node := range nodes.Heap {
+		edges := []hnsw.Pointer{}
+		for _, e := range node.Connections[0] {
+			if !slices.Contains(orphans, e) {
+				edges = append(edges, e)
+			}
+		}
+		nodes.Heap[addr].Connections[0] = edges
+	}
+
+	broken := hnsw.FromNodes(vector.SurfaceVF32(surface.Euclidean()), nodes, hnsw.WithM0(64))
+	if stats := broken.Stats(); stats.Levels[0].Unreachable < len(orphans) {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	if fixed := broken.Repair(); fixed < 1 || fixed > len(orphans) {
+		t.Errorf("Unexpected number of fixed nodes %d", fixed)
+	}
+
+	if stats := broken.Stats(); stats.Levels[0].Unreachable != 0 {
+		t.Errorf("Unexpected stats %v", stats)
+	}
+
+	for _, addr := range orphans {
+		q := nodes.Heap[addr].Vector
+		if seq := broken.Search(q, 1, 100); seq[0].Key != q.Key {
+			t.Errorf("Not found %v in %v", q, seq)
+		}
+	}
+
+	if fixed := broken.Repair(); fixed != 0 {
+		t.Errorf("Unexpected number of fixed nodes %d", fixed)
+	}
+}
+
 func TestUpdate(t *testing.T) {
 	for _, df := range []surface.Surface[surface.F32]{
 		surface.Euclidean(),
@@ -79,8 +1471,147 @@ func TestUpdate(t *testing.T) {
 	}
 }
 
+func TestDelete(t *testing.T) {
+	for _, df := range []surface.Surface[surface.F32]{
+		surface.Euclidean(),
+		surface.Cosine(),
+	} {
+		index := sut(df)
+		for i, v := range vectors {
+			index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+		}
+
+		// Delete every even vector, including the head
+		index.Delete(index.Head())
+		for i, v := range vectors {
+			if i%2 == 0 {
+				index.Delete(vector.VF32{Key: uint32(i), Vec: v})
+			}
+		}
+
+		for i, v := range vectors {
+			q := vector.VF32{Key: uint32(i), Vec: v}
+			seq := index.Search(q, 1, 100)
+
+			if i%2 == 0 && len(seq) > 0 && seq[0].Key == q.Key {
+				t.Errorf("Deleted %v is found", q)
+			}
+		}
+
+		for _, q := range nodes(index) {
+			if q.Key%2 == 0 {
+				t.Errorf("Deleted %v is visited", q)
+			}
+
+			seq := index.Search(q, 1, 100)
+			if seq[0].Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+
+		if len(nodes(index)) < n/2-1 {
+			t.Errorf("Graph is disconnected, %d nodes are reachable", len(nodes(index)))
+		}
+	}
+}
+
+func TestCompact(t *testing.T) {
+	for _, df := range []surface.Surface[surface.F32]{
+		surface.Euclidean(),
+		surface.Cosine(),
+	} {
+		index := sut(df)
+		for i, v := range vectors {
+			index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+		}
+
+		index.Delete(vector.VF32{Key: 1, Vec: vectors[1]})
+		reclaimed := index.Compact(func(v vector.VF32) bool { return v.Key%2 == 1 })
+		if reclaimed != n/2+1 || index.Size() != n/2-1 {
+			t.Errorf("Not compacted %d, size %d", reclaimed, index.Size())
+		}
+
+		for _, q := range nodes(index) {
+			if q.Key%2 == 0 || q.Key == 1 {
+				t.Errorf("Dropped %v is visited", q)
+			}
+
+			seq := index.Search(q, 1, 100)
+			if seq[0].Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+		}
+
+		if index.Compact(nil) != 0 {
+			t.Errorf("Compacted twice")
+		}
+	}
+}
+
 //------------------------------------------------------------------------------
 
+// in-memory key/value storage
+type kv map[string][]byte
+
+func (kv kv) Get(key []byte) ([]byte, error) { return kv[string(key)], nil }
+
+func (kv kv) Put(key, val []byte) error {
+	kv[string(key)] = val
+	return nil
+}
+
+// in-memory key/value storage with batches and scans
+type batchkv struct {
+	kv
+	fail int // number of puts before failure, never fails if 0
+}
+
+func (kv *batchkv) Batch() (hnsw.Batch, error) {
+	return &batch{store: kv, puts: map[string][]byte{}}, nil
+}
+
+func (kv *batchkv) GetBatch(keys [][]byte) ([][]byte, error) {
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		vals[i] = kv.kv[string(key)]
+	}
+	return vals, nil
+}
+
+func (kv *batchkv) Scan(prefix []byte, f func(key, val []byte) error) error {
+	for key, val := range kv.kv {
+		if bytes.HasPrefix([]byte(key), prefix) {
+			if err := f([]byte(key), val); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+type batch struct {
+	store *batchkv
+	puts  map[string][]byte
+}
+
+func (b *batch) Put(key, val []byte) error {
+	if b.store.fail > 0 && len(b.puts) == b.store.fail {
+		return fmt.Errorf("failed")
+	}
+
+	b.puts[string(key)] = val
+	return nil
+}
+
+func (b *batch) Commit() error {
+	for key, val := range b.puts {
+		b.store.kv[key] = val
+	}
+	return nil
+}
+
+func (b *batch) Rollback() { b.puts = nil }
+
 func random() float32 {
 again:
 	f := float64(rnd.Int63()) / (1 << 63)
@@ -106,6 +1637,20 @@ func rndVectors() []surface.F32 {
 	return vecs
 }
 
+func equal(a, b surface.F32) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
 func nodes(index *hnsw.HNSW[vector.VF32]) []vector.VF32 {
 	nodes := make([]vector.VF32, 0)
 	index.ForAll(0,
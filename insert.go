@@ -9,9 +9,10 @@
 package hnsw
 
 import (
+	"context"
 	"math"
+	"slices"
 
-	"github.com/fogfish/hnsw/internal/pq"
 	"github.com/fogfish/hnsw/internal/types"
 )
 
@@ -22,7 +23,9 @@ const maxEps = +1e-6
 // generate random float from random source generator
 func (h *HNSW[Vector]) rand() float64 {
 again:
+	h.rwRandom.Lock()
 	f := float64(h.config.random.Int63()) / (1 << 63)
+	h.rwRandom.Unlock()
 	if f == 1 {
 		goto again // resample; this branch is taken O(never)
 	}
@@ -30,7 +33,42 @@ again:
 }
 
 // Insert vector
+//
+// Errors of write-ahead log are not returned, they are reported by WAL.Err.
+// Use InsertContext if the durability of insert is required.
 func (h *HNSW[Vector]) Insert(v Vector) {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	h.insert(context.Background(), v, true)
+	h.log(walInsert, v)
+}
+
+// Insert vector within the context.
+//
+// The insert is aborted if the context is done while the neighborhood of
+// new node is searched, the index is not modified in this case and the
+// context error is returned. Once the node is appended to the heap, the
+// insert always completes linking to keep the graph consistent. The error
+// of write-ahead log is returned, the insert is not durable in this case.
+func (h *HNSW[Vector]) InsertContext(ctx context.Context, v Vector) error {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	if _, err := h.insert(ctx, v, true); err != nil {
+		return err
+	}
+
+	return h.log(walInsert, v)
+}
+
+// insert vector, returning address of the node. Equal vector is updated
+// in-place if it is allowed.
+func (h *HNSW[Vector]) insert(ctx context.Context, v Vector, inplace bool) (Pointer, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+
 	//
 	// allocate new node
 	//
@@ -45,14 +83,15 @@ func (h *HNSW[Vector]) Insert(v Vector) {
 	//
 	// Empty insert
 	//
-	if len(h.heap) == 0 {
+	if h.Size() == 0 {
 		h.rwCore.Lock()
 		if len(h.heap) == 0 {
 			h.heap = append(h.heap, node)
 			h.level = len(node.Connections)
 			h.head = addr
 			h.rwCore.Unlock()
-			return
+			h.touch(addr)
+			return addr, nil
 		}
 		h.rwCore.Unlock()
 	}
@@ -80,41 +119,45 @@ func (h *HNSW[Vector]) Insert(v Vector) {
 			M = h.config.mLayer0
 		}
 
-		w := h.searchLayer(lvl, head, v, h.config.efConstruction)
-
-		for w.Len() > M {
-			w.Deq()
+		w := h.searchLayer(ctx, lvl, head, v, h.config.efConstruction, nil)
+		if err := ctx.Err(); err != nil {
+			return 0, err
 		}
+		candidates := drain(w)
 
-		// Add Edges from new node to existing one
-		edges := make([]Pointer, w.Len())
-		for i := w.Len() - 1; i >= 0; i-- {
-			candidate := w.Deq()
-			edges[i] = candidate.Addr
-
-			// Consider the update
+		// Consider the update
+		if inplace && len(candidates) > 0 {
+			candidate := candidates[0]
 			if minEps < candidate.Distance && candidate.Distance < maxEps {
-				if h.surface.Equal(h.heap[candidate.Addr].Vector, v) {
-					h.heap[candidate.Addr].Vector = v
-					return
+				if cv, ok := h.load(candidate.Addr); ok && h.surface.Equal(cv, v) {
+					h.update(candidate.Addr, func(n *Node[Vector]) { n.Vector = v })
+					h.resident(candidate.Addr)
+					h.touch(candidate.Addr)
+					return candidate.Addr, nil
 				}
 			}
 		}
-		node.Connections[lvl] = edges
+
+		// Add Edges from new node to existing one
+		node.Connections[lvl] = h.selectNeighbors(lvl, v, candidates, M)
 	}
 
 	//
 	// Append new node
 	//
 
+	// connections of the node are modified concurrently once it is appended
+	links := slices.Clone(node.Connections)
+
 	h.rwCore.Lock()
 	addr = Pointer(len(h.heap))
 	h.rwHeap[addr%heapRWSlots].Lock()
 	h.heap = append(h.heap, node)
 	h.rwHeap[addr%heapRWSlots].Unlock()
 	h.rwCore.Unlock()
+	h.touch(addr)
 
-	for lvl, edges := range node.Connections {
+	for lvl, edges := range links {
 		for i := 0; i < len(edges); i++ {
 			h.addConnection(lvl, edges[i], addr)
 		}
@@ -124,52 +167,9 @@ func (h *HNSW[Vector]) Insert(v Vector) {
 	// Shrink Connections
 	//
 
-	for lvl, edges := range node.Connections {
-		M := h.config.mLayerN
-		if lvl == 0 {
-			M = h.config.mLayer0
-		}
-
+	for lvl, edges := range links {
 		for _, e := range edges {
-			slot := e % heapRWSlots
-			h.rwHeap[slot].RLock()
-			enode := h.heap[e]
-			eedges := enode.Connections[lvl]
-			h.rwHeap[slot].RUnlock()
-
-			if len(eedges) > M {
-				edges := pq.New(types.OrdReverseVertex)
-
-				for _, n := range eedges {
-					if n != addr {
-						nnode := h.heap[n]
-
-						dist := h.surface.Distance(enode.Vector, nnode.Vector)
-						item := types.Vertex{Distance: dist, Addr: n}
-						edges.Enq(item)
-					}
-				}
-
-				for edges.Len() > M-1 {
-					edges.Deq()
-				}
-
-				// Note: adjustment to original algorithms.
-				//       new connection is always created into the target node.
-				//       it reduces probability for new node to be disconnected.
-				dist := h.surface.Distance(enode.Vector, node.Vector)
-				item := types.Vertex{Distance: dist, Addr: addr}
-				edges.Enq(item)
-
-				conns := make([]Pointer, edges.Len())
-				for i := edges.Len() - 1; i >= 0; i-- {
-					conns[i] = edges.Deq().Addr
-				}
-
-				h.rwHeap[slot].Lock()
-				h.heap[e].Connections[lvl] = conns
-				h.rwHeap[slot].Unlock()
-			}
+			h.shrinkConnections(lvl, e, addr)
 		}
 	}
 
@@ -178,22 +178,73 @@ func (h *HNSW[Vector]) Insert(v Vector) {
 	//
 
 	h.rwCore.Lock()
-	if len(node.Connections) > h.level {
-		h.level = len(node.Connections)
+	if len(links) > h.level || h.heap[h.head].Deleted {
+		h.level = len(links)
 		h.head = addr
 	}
 	h.rwCore.Unlock()
+
+	return addr, nil
 }
 
-func (h *HNSW[Vector]) addConnection(level int, src, dst Pointer) {
-	slot := src % heapRWSlots
+// shrink neighbors of node e connected to the node addr, the connection
+// to addr is kept.
+func (h *HNSW[Vector]) shrinkConnections(lvl int, e, addr Pointer) {
+	M := h.config.mLayerN
+	if lvl == 0 {
+		M = h.config.mLayer0
+	}
+
+	eedges := h.links(e, lvl)
+
+	if len(eedges) > M {
+		evector, ok := h.load(e)
+		if !ok {
+			return
+		}
+
+		candidates := make([]types.Vertex, 0, len(eedges))
+		for _, n := range eedges {
+			if n == addr {
+				continue
+			}
+
+			if nvector, ok := h.load(n); ok {
+				dist := h.surface.Distance(evector, nvector)
+				candidates = append(candidates, types.Vertex{Distance: dist, Addr: n})
+			}
+		}
+		slices.SortFunc(candidates, types.OrdForwardVertex.Compare)
 
-	h.rwHeap[slot].RLock()
-	n := h.heap[src]
-	c := n.Connections[level]
-	h.rwHeap[slot].RUnlock()
+		conns := h.selectNeighbors(lvl, evector, candidates, M-1, e, addr)
 
-	h.rwHeap[slot].Lock()
-	n.Connections[level] = append(c, dst)
-	h.rwHeap[slot].Unlock()
+		// Note: adjustment to original algorithms.
+		//       new connection is always created into the target node.
+		//       it reduces probability for new node to be disconnected.
+		conns = append(conns, addr)
+
+		// edges appended while connections are selected are kept
+		h.update(e, func(n *Node[Vector]) {
+			n.Connections[lvl] = merge(conns, n.Connections[lvl], eedges)
+		})
+		h.touch(e)
+	}
+}
+
+func (h *HNSW[Vector]) addConnection(level int, src, dst Pointer) {
+	h.update(src, func(n *Node[Vector]) {
+		n.Connections[level] = append(n.Connections[level], dst)
+	})
+	h.touch(src)
+}
+
+// merge selected connections with edges appended to the current list since
+// the snapshot was taken
+func merge(conns, current, snapshot []Pointer) []Pointer {
+	for _, e := range current {
+		if !slices.Contains(snapshot, e) && !slices.Contains(conns, e) {
+			conns = append(conns, e)
+		}
+	}
+	return conns
 }
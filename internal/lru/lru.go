@@ -0,0 +1,74 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package lru
+
+import (
+	"container/list"
+)
+
+// Cache with bounded capacity, the least recently used entry is evicted.
+// The cache is not safe for concurrent use.
+type Cache[K comparable, V any] struct {
+	capacity int
+	order    *list.List
+	entries  map[K]*list.Element
+}
+
+type entry[K comparable, V any] struct {
+	key K
+	val V
+}
+
+func New[K comparable, V any](capacity int) *Cache[K, V] {
+	return &Cache[K, V]{
+		capacity: max(capacity, 1),
+		order:    list.New(),
+		entries:  make(map[K]*list.Element, capacity),
+	}
+}
+
+func (c *Cache[K, V]) Len() int { return c.order.Len() }
+
+func (c *Cache[K, V]) Has(key K) bool {
+	_, has := c.entries[key]
+	return has
+}
+
+func (c *Cache[K, V]) Get(key K) (V, bool) {
+	e, has := c.entries[key]
+	if !has {
+		return *new(V), false
+	}
+
+	c.order.MoveToFront(e)
+	return e.Value.(*entry[K, V]).val, true
+}
+
+func (c *Cache[K, V]) Put(key K, val V) {
+	if e, has := c.entries[key]; has {
+		e.Value.(*entry[K, V]).val = val
+		c.order.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.order.PushFront(&entry[K, V]{key: key, val: val})
+
+	if c.order.Len() > c.capacity {
+		e := c.order.Back()
+		c.order.Remove(e)
+		delete(c.entries, e.Value.(*entry[K, V]).key)
+	}
+}
+
+func (c *Cache[K, V]) Remove(key K) {
+	if e, has := c.entries[key]; has {
+		c.order.Remove(e)
+		delete(c.entries, key)
+	}
+}
@@ -0,0 +1,43 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package lru_test
+
+import (
+	"testing"
+
+	"github.com/fogfish/hnsw/internal/lru"
+	"github.com/fogfish/it/v2"
+)
+
+func TestLRU(t *testing.T) {
+	c := lru.New[int, string](2)
+	c.Put(1, "a")
+	c.Put(2, "b")
+
+	v, has := c.Get(1)
+	it.Then(t).Should(
+		it.True(has),
+		it.Equal(v, "a"),
+	)
+
+	// 2 is the least recently used
+	c.Put(3, "c")
+	it.Then(t).Should(
+		it.Equal(c.Len(), 2),
+		it.True(c.Has(1)),
+		it.True(!c.Has(2)),
+		it.True(c.Has(3)),
+	)
+
+	c.Remove(1)
+	it.Then(t).Should(
+		it.Equal(c.Len(), 1),
+		it.True(!c.Has(1)),
+	)
+}
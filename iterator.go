@@ -19,6 +19,7 @@ import (
 type FMap[Vector any] func(rank int, vector Vector, edges []Vector) error
 
 // Breadth-first search iterator over all nodes linked at the level.
+// Deleted nodes are traversed but not visited.
 //
 // This method provides an iterator that traverses all nodes linked at a specific
 // level of the graph. By performing a full scan, the `ForAll` method ensures
@@ -38,16 +39,16 @@ func (h *HNSW[Vector]) forNode(level int, addr Pointer, visited *bitset.BitSet,
 
 	node := h.heap[addr]
 
-	var edges []Vector
-	if len(node.Connections) > level {
-		edges = make([]Vector, len(node.Connections[level]))
-		for i, addr := range node.Connections[level] {
-			edges[i] = h.heap[addr].Vector
+	// nodes are traversed without visiting if fmap is not defined
+	if !node.Deleted && fmap != nil {
+		var edges []Vector
+		if len(node.Connections) > level {
+			edges = h.edges(node.Connections[level])
 		}
-	}
 
-	if err := fmap(len(node.Connections), node.Vector, edges); err != nil {
-		return err
+		if err := fmap(len(node.Connections), h.vector(addr), edges); err != nil {
+			return err
+		}
 	}
 
 	if len(node.Connections) > level {
@@ -63,14 +64,11 @@ func (h *HNSW[Vector]) forNode(level int, addr Pointer, visited *bitset.BitSet,
 
 // Heap iterator over data structure
 func (h *HNSW[Vector]) FMap(level int, fmap FMap[Vector]) error {
-	for _, node := range h.heap {
-		if len(node.Connections) > level {
-			edges := make([]Vector, len(node.Connections[level]))
-			for i, addr := range node.Connections[level] {
-				edges[i] = h.heap[addr].Vector
-			}
+	for addr, node := range h.heap {
+		if !node.Deleted && len(node.Connections) > level {
+			edges := h.edges(node.Connections[level])
 
-			if err := fmap(len(node.Connections), node.Vector, edges); err != nil {
+			if err := fmap(len(node.Connections), h.vector(Pointer(addr)), edges); err != nil {
 				return err
 			}
 		}
@@ -79,6 +77,17 @@ func (h *HNSW[Vector]) FMap(level int, fmap FMap[Vector]) error {
 	return nil
 }
 
+// vectors of alive nodes linked by edges
+func (h *HNSW[Vector]) edges(conns []Pointer) []Vector {
+	edges := make([]Vector, 0, len(conns))
+	for _, addr := range conns {
+		if node := h.heap[addr]; !node.Deleted {
+			edges = append(edges, h.vector(addr))
+		}
+	}
+	return edges
+}
+
 // Dump index as text
 func (h *HNSW[Vector]) Dump(w io.Writer, f func(Vector) string) {
 	for lvl := h.level - 1; lvl >= 0; lvl-- {
@@ -0,0 +1,492 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+
+	"github.com/kelindar/binary"
+	"github.com/kshard/vector"
+)
+
+// Hierarchical Navigable Small World Graph with vectors addressable by
+// the external key. The key is extracted from vectors by the function.
+//
+// The structure maintains unique vector per key: Insert acts as Upsert,
+// Delete removes vector by its key.
+type Keyed[K comparable, Vector any] struct {
+	*HNSW[Vector]
+	rwKeys sync.RWMutex
+	key    func(Vector) K
+	keys   map[K]Pointer
+
+	// number of keymap deltas written since the keymap
+	keylog uint32
+}
+
+// Creates keyed Hierarchical Navigable Small World Graph
+//
+//	index := hnsw.NewKeyed(
+//		vector.SurfaceVF32(surface.Cosine()),
+//		func(v vector.VF32) uint32 { return v.Key },
+//	)
+func NewKeyed[K comparable, Vector any](
+	surface vector.Surface[Vector],
+	key func(Vector) K,
+	opts ...Option,
+) *Keyed[K, Vector] {
+	return &Keyed[K, Vector]{
+		HNSW: New(surface, opts...),
+		key:  key,
+		keys: make(map[K]Pointer),
+	}
+}
+
+// Get vector by key
+func (k *Keyed[K, Vector]) Get(key K) (Vector, bool) {
+	k.rwCompact.RLock()
+	defer k.rwCompact.RUnlock()
+
+	k.rwKeys.RLock()
+	addr, has := k.keys[key]
+	k.rwKeys.RUnlock()
+
+	if !has {
+		return *new(Vector), false
+	}
+
+	return k.vector(addr), true
+}
+
+// Check existence of the key
+func (k *Keyed[K, Vector]) Has(key K) bool {
+	k.rwKeys.RLock()
+	defer k.rwKeys.RUnlock()
+
+	_, has := k.keys[key]
+	return has
+}
+
+// Insert vector, equivalent to Upsert
+func (k *Keyed[K, Vector]) Insert(v Vector) { k.Upsert(v) }
+
+// Insert vector within the context, equivalent to Upsert. The index is not
+// modified if the context is done before the vector is linked, the context
+// error is returned. See HNSW.InsertContext for details.
+func (k *Keyed[K, Vector]) InsertContext(ctx context.Context, v Vector) error {
+	k.rwCompact.RLock()
+	defer k.rwCompact.RUnlock()
+
+	if err := k.upsert(ctx, v); err != nil {
+		return err
+	}
+
+	return k.log(walInsert, v)
+}
+
+// Insert or update vector
+//
+// The vector is updated in-place if it is equal to existing one with the
+// same key (e.g. only attributes are changed). Otherwise, the vector is
+// linked into the graph and existing node is deleted. Concurrent upserts of
+// the same key keep the vector of the last writer. Errors of write-ahead log
+// are reported by WAL.Err.
+func (k *Keyed[K, Vector]) Upsert(v Vector) {
+	k.rwCompact.RLock()
+	defer k.rwCompact.RUnlock()
+
+	k.upsert(context.Background(), v)
+	k.log(walInsert, v)
+}
+
+func (k *Keyed[K, Vector]) upsert(ctx context.Context, v Vector) error {
+	key := k.key(v)
+
+	k.rwKeys.RLock()
+	addr, has := k.keys[key]
+	k.rwKeys.RUnlock()
+
+	if has {
+		if old, ok := k.load(addr); ok && k.surface.Equal(old, v) {
+			k.update(addr, func(n *Node[Vector]) { n.Vector = v })
+			k.resident(addr)
+			k.touch(addr)
+			return nil
+		}
+	}
+
+	// existing node is deleted once the vector is linked, so that
+	// the cancelled upsert keeps it
+	node, err := k.insert(ctx, v, false)
+	if err != nil {
+		return err
+	}
+
+	k.rwKeys.Lock()
+	prev, exists := k.keys[key]
+	k.keys[key] = node
+	k.rwKeys.Unlock()
+
+	// either existing node or the node of concurrent upsert, the last
+	// writer wins
+	if exists {
+		k.deletePointer(prev)
+	}
+
+	return nil
+}
+
+// Create pipe for batch upsert. See HNSW.Pipe for details.
+func (k *Keyed[K, Vector]) Pipe(workers int) *Pipe[Vector] {
+	return k.PipeContext(context.Background(), workers, nil)
+}
+
+// Create pipe for batch upsert, bound to the context. See HNSW.PipeContext
+// for details.
+func (k *Keyed[K, Vector]) PipeContext(ctx context.Context, workers int, progress func(int)) *Pipe[Vector] {
+	return newPipe(ctx, workers, k.Upsert, progress)
+}
+
+// Delete vector by key, returns false if key is not found. Errors of
+// write-ahead log are reported by WAL.Err.
+func (k *Keyed[K, Vector]) DeleteKey(key K) bool {
+	k.rwCompact.RLock()
+	defer k.rwCompact.RUnlock()
+
+	addr, has := k.deleteKey(key)
+	if !has {
+		return false
+	}
+
+	k.log(walDelete, k.vector(addr))
+	return true
+}
+
+func (k *Keyed[K, Vector]) deleteKey(key K) (Pointer, bool) {
+	k.rwKeys.Lock()
+	addr, has := k.keys[key]
+	delete(k.keys, key)
+	k.rwKeys.Unlock()
+
+	if !has {
+		return 0, false
+	}
+
+	return addr, k.deletePointer(addr)
+}
+
+// Delete vector, equivalent to DeleteKey.
+func (k *Keyed[K, Vector]) Delete(v Vector) bool {
+	return k.DeleteKey(k.key(v))
+}
+
+// Delete node at the address. See HNSW.Delete for details.
+func (k *Keyed[K, Vector]) DeletePointer(addr Pointer) bool {
+	k.rwCompact.RLock()
+	defer k.rwCompact.RUnlock()
+
+	if !k.deletePointer(addr) {
+		return false
+	}
+
+	v := k.vector(addr)
+	key := k.key(v)
+
+	k.rwKeys.Lock()
+	if k.keys[key] == addr {
+		delete(k.keys, key)
+	}
+	k.rwKeys.Unlock()
+
+	k.log(walDelete, v)
+	return true
+}
+
+// Compact heap, reclaiming slots of deleted nodes. See HNSW.Compact for details.
+func (k *Keyed[K, Vector]) Compact(keep func(Vector) bool) int {
+	return k.compactWith(keep,
+		func(remap []Pointer) {
+			k.rwKeys.Lock()
+			defer k.rwKeys.Unlock()
+
+			for key, addr := range k.keys {
+				if remap[addr] == nilPointer {
+					delete(k.keys, key)
+				} else {
+					k.keys[key] = remap[addr]
+				}
+			}
+		},
+	)
+}
+
+// Write index together with keys
+func (k *Keyed[K, Vector]) Write(w Writer) error {
+	k.rwCompact.Lock()
+	defer k.rwCompact.Unlock()
+
+	k.rwKeys.RLock()
+	defer k.rwKeys.RUnlock()
+
+	err := commit(w, func(w Writer) error {
+		if err := k.write(w); err != nil {
+			return err
+		}
+
+		return k.writeKeys(w)
+	})
+	if err != nil {
+		return err
+	}
+
+	k.checkpoint()
+	k.keylog = 0
+
+	return k.truncateLog()
+}
+
+// Write changed nodes together with keys. See HNSW.WriteDelta for details.
+//
+// Keys of changed nodes are appended to the storage as the delta of keymap.
+// Read merges deltas into the keymap, Write replaces them with the keymap.
+func (k *Keyed[K, Vector]) WriteDelta(w Writer) error {
+	k.rwCompact.Lock()
+	defer k.rwCompact.Unlock()
+
+	k.rwKeys.RLock()
+	defer k.rwKeys.RUnlock()
+
+	keylog := uint32(0)
+	err := commit(w, func(w Writer) (err error) {
+		if err := k.writeDelta(w); err != nil {
+			return err
+		}
+
+		keylog, err = k.writeKeysDelta(w)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	k.checkpoint()
+	k.keylog = keylog
+
+	return k.truncateLog()
+}
+
+func (k *Keyed[K, Vector]) writeKeys(w Writer) error {
+	b, err := binary.Marshal(k.keys)
+	if err != nil {
+		return errCodec.New(err)
+	}
+
+	err = w.Put([]byte("&keymap"), b)
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	return k.writeKeylog(w, 0)
+}
+
+// write keys of nodes changed since the last checkpoint, deleted keys are
+// mapped to nilPointer. The entire keymap is written if all nodes are changed.
+func (k *Keyed[K, Vector]) writeKeysDelta(w Writer) (uint32, error) {
+	k.rwDirty.Lock()
+	all := k.dirtyAll
+	dirty := k.dirty.Clone()
+	k.rwDirty.Unlock()
+
+	if all {
+		return 0, k.writeKeys(w)
+	}
+
+	delta := make(map[K]Pointer)
+	for addr, ok := dirty.NextSet(0); ok && addr < uint(len(k.heap)); addr, ok = dirty.NextSet(addr + 1) {
+		v, ok := k.load(Pointer(addr))
+		if !ok {
+			return 0, k.Err()
+		}
+
+		key := k.key(v)
+		if ptr, has := k.keys[key]; has {
+			delta[key] = ptr
+		} else {
+			delta[key] = nilPointer
+		}
+	}
+
+	b, err := binary.Marshal(delta)
+	if err != nil {
+		return 0, errCodec.New(err)
+	}
+
+	keylog := k.keylog + 1
+	err = w.Put(keymapKey(keylog), b)
+	if err != nil {
+		return 0, errIO.New(err)
+	}
+
+	return keylog, k.writeKeylog(w, keylog)
+}
+
+func (k *Keyed[K, Vector]) writeKeylog(w Writer, keylog uint32) error {
+	err := w.Put([]byte("&keylog"), binary.LittleEndian.AppendUint32(nil, keylog))
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	return nil
+}
+
+// Read index together with keys. Keys are rebuilt from vectors if they
+// are not persisted.
+func (k *Keyed[K, Vector]) Read(r Reader) error {
+	k.rwCompact.Lock()
+	defer k.rwCompact.Unlock()
+
+	k.rwKeys.Lock()
+	defer k.rwKeys.Unlock()
+
+	if err := k.read(r, nil); err != nil {
+		return err
+	}
+
+	return k.readKeys(r)
+}
+
+// Read index together with keys, vectors are fetched lazily from
+// the storage. See HNSW.ReadLazy for details.
+func (k *Keyed[K, Vector]) ReadLazy(r Reader, cache int) error {
+	k.rwCompact.Lock()
+	defer k.rwCompact.Unlock()
+
+	k.rwKeys.Lock()
+	defer k.rwKeys.Unlock()
+
+	if err := k.read(r, newLazy(r, cache, k.unsealNode)); err != nil {
+		return err
+	}
+
+	return k.readKeys(r)
+}
+
+func (k *Keyed[K, Vector]) readKeys(r Reader) error {
+	b, err := r.Get([]byte("&keymap"))
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	k.keys = make(map[K]Pointer)
+	k.keylog = 0
+	if len(b) == 0 {
+		k.rebuildKeys()
+		return nil
+	}
+
+	if err := binary.Unmarshal(b, &k.keys); err != nil {
+		return errCodec.New(err)
+	}
+
+	b, err = r.Get([]byte("&keylog"))
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	if len(b) != 4 {
+		return errCodec.New(fmt.Errorf("invalid keylog"))
+	}
+
+	keylog := binary.LittleEndian.Uint32(b)
+	for seq := uint32(1); seq <= keylog; seq++ {
+		b, err := r.Get(keymapKey(seq))
+		if err != nil {
+			return errIO.New(err)
+		}
+
+		var delta map[K]Pointer
+		if err := binary.Unmarshal(b, &delta); err != nil {
+			return errCodec.New(err)
+		}
+
+		for key, addr := range delta {
+			if addr == nilPointer {
+				delete(k.keys, key)
+			} else {
+				k.keys[key] = addr
+			}
+		}
+	}
+	k.keylog = keylog
+
+	return nil
+}
+
+func keymapKey(seq uint32) []byte {
+	return binary.LittleEndian.AppendUint32([]byte("&keymap"), seq)
+}
+
+// ReadFrom reads index from self-describing single file snapshot, keys
+// are rebuilt from vectors. See HNSW.ReadFrom for details.
+func (k *Keyed[K, Vector]) ReadFrom(r io.Reader) (int64, error) {
+	k.rwCompact.Lock()
+	defer k.rwCompact.Unlock()
+
+	k.rwKeys.Lock()
+	defer k.rwKeys.Unlock()
+
+	n, err := k.readFrom(r)
+	if err != nil {
+		return n, err
+	}
+
+	k.keys = make(map[K]Pointer)
+	k.rebuildKeys()
+
+	return n, nil
+}
+
+// Recover index together with keys from the last snapshot and write-ahead
+// log. See HNSW.Recover for details.
+func (k *Keyed[K, Vector]) Recover(r Reader) error {
+	if err := k.readSnapshot(r, k.Read); err != nil {
+		return err
+	}
+
+	return k.replay(
+		func(v Vector) {
+			k.rwCompact.RLock()
+			defer k.rwCompact.RUnlock()
+
+			k.upsert(context.Background(), v)
+		},
+		func(v Vector) {
+			k.rwCompact.RLock()
+			defer k.rwCompact.RUnlock()
+
+			k.deleteKey(k.key(v))
+		},
+	)
+}
+
+// rebuild keys from vectors
+func (k *Keyed[K, Vector]) rebuildKeys() {
+	for addr, node := range k.heap {
+		if !node.Deleted {
+			k.keys[k.key(k.vector(Pointer(addr)))] = Pointer(addr)
+		}
+	}
+}
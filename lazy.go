@@ -0,0 +1,211 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"sync"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw/internal/lru"
+)
+
+// disk-resident vectors, fetched lazily from the storage
+type lazy[Vector any] struct {
+	sync.Mutex
+	reader  Reader
+	decode  func(Pointer, []byte, int) (Node[Vector], error)
+	version int
+	cache   *lru.Cache[Pointer, Vector]
+	disk    bitset.BitSet
+	err     error
+}
+
+func newLazy[Vector any](r Reader, cache int, decode func(Pointer, []byte, int) (Node[Vector], error)) *lazy[Vector] {
+	return &lazy[Vector]{
+		reader: r,
+		decode: decode,
+		cache:  lru.New[Pointer, Vector](cache),
+	}
+}
+
+// Read index, keeping only the graph in memory.
+//
+// Vectors remain in the storage, they are fetched lazily while the graph is
+// traversed and retained by the cache of the given capacity (number of
+// vectors). Vectors of neighbors are prefetched concurrently when the node is
+// expanded. Inserted and updated vectors are kept in memory.
+//
+// The storage must outlive the index. The heap of disk-resident index is not
+// compacted. Nodes, which vectors are failed to fetch, are skipped by the
+// search. Errors of fetching vectors are reported by Err. Use compressed
+// vectors (see package vector) together with SearchRerank to keep
+// approximation of vectors in memory.
+func (h *HNSW[Vector]) ReadLazy(r Reader, cache int) error {
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	return h.read(r, newLazy(r, cache, h.unsealNode))
+}
+
+// Err returns the first error of fetching disk-resident vectors.
+func (h *HNSW[Vector]) Err() error {
+	if h.lazy == nil {
+		return nil
+	}
+
+	h.lazy.Lock()
+	defer h.lazy.Unlock()
+
+	return h.lazy.err
+}
+
+// vector of the node, disk-resident vectors are fetched lazily
+func (h *HNSW[Vector]) vector(addr Pointer) Vector {
+	v, _ := h.load(addr)
+	return v
+}
+
+// load vector of the node, it returns false if disk-resident vector is
+// failed to fetch. The error is reported by Err.
+func (h *HNSW[Vector]) load(addr Pointer) (Vector, bool) {
+	return h.resolve(addr, h.node(addr).Vector)
+}
+
+// resolve vector of the node, the resident vector is given by the caller
+// holding locks of the heap. Disk-resident vectors are fetched lazily.
+func (h *HNSW[Vector]) resolve(addr Pointer, v Vector) (Vector, bool) {
+	if h.lazy == nil {
+		return v, true
+	}
+
+	l := h.lazy
+	l.Lock()
+	if !l.disk.Test(uint(addr)) {
+		l.Unlock()
+		return v, true
+	}
+
+	if v, has := l.cache.Get(addr); has {
+		l.Unlock()
+		return v, true
+	}
+	l.Unlock()
+
+	v, err := l.fetch(addr)
+
+	l.Lock()
+	defer l.Unlock()
+	if err != nil {
+		if l.err == nil {
+			l.err = err
+		}
+		return v, false
+	}
+
+	l.cache.Put(addr, v)
+	return v, true
+}
+
+// fetch vectors of nodes that are neither resident nor cached
+func (h *HNSW[Vector]) prefetch(addrs []Pointer) {
+	if h.lazy == nil {
+		return
+	}
+
+	l := h.lazy
+	l.Lock()
+	missing := make([]Pointer, 0, len(addrs))
+	for _, addr := range addrs {
+		if l.disk.Test(uint(addr)) && !l.cache.Has(addr) {
+			missing = append(missing, addr)
+		}
+	}
+	l.Unlock()
+
+	if len(missing) < 2 {
+		return
+	}
+
+	vectors, errs := l.fetchAll(missing)
+
+	l.Lock()
+	defer l.Unlock()
+	for i, addr := range missing {
+		if errs[i] != nil {
+			if l.err == nil {
+				l.err = errs[i]
+			}
+			continue
+		}
+		l.cache.Put(addr, vectors[i])
+	}
+}
+
+// mark vector of the node as resident in memory (e.g. updated in-place)
+func (h *HNSW[Vector]) resident(addr Pointer) {
+	if h.lazy == nil {
+		return
+	}
+
+	h.lazy.Lock()
+	h.lazy.disk.Clear(uint(addr))
+	h.lazy.cache.Remove(addr)
+	h.lazy.Unlock()
+}
+
+// fetch vectors in one round-trip if the storage supports batches, otherwise
+// concurrently
+func (l *lazy[Vector]) fetchAll(addrs []Pointer) ([]Vector, []error) {
+	vectors := make([]Vector, len(addrs))
+	errs := make([]error, len(addrs))
+
+	if r, ok := l.reader.(BatchReader); ok {
+		keys := make([][]byte, len(addrs))
+		for i, addr := range addrs {
+			keys[i] = nodeKey(addr)
+		}
+
+		vals, err := r.GetBatch(keys)
+		for i := range addrs {
+			if err != nil {
+				errs[i] = errIO.New(err)
+				continue
+			}
+			vectors[i], errs[i] = l.decodeVector(addrs[i], vals[i])
+		}
+
+		return vectors, errs
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(len(addrs))
+	for i, addr := range addrs {
+		go func() {
+			defer wg.Done()
+			vectors[i], errs[i] = l.fetch(addr)
+		}()
+	}
+	wg.Wait()
+
+	return vectors, errs
+}
+
+func (l *lazy[Vector]) fetch(addr Pointer) (Vector, error) {
+	b, err := l.reader.Get(nodeKey(addr))
+	if err != nil {
+		return *new(Vector), errIO.New(err)
+	}
+
+	return l.decodeVector(addr, b)
+}
+
+func (l *lazy[Vector]) decodeVector(addr Pointer, b []byte) (Vector, error) {
+	node, err := l.decode(addr, b, l.version)
+	return node.Vector, err
+}
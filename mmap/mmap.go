@@ -0,0 +1,485 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+// Package mmap implements read-only Hierarchical Navigable Small World Graph
+// backed by memory mapped file. The search works directly over mapped pages,
+// the startup cost is independent of the index size.
+//
+// The file layout consists of fixed-width adjacency blocks and contiguous
+// regions of keys and float32 vectors (all integers are little endian):
+//
+//	header    | magic "HNSWMMAP", version, dim, size, head, level, M0, M, blocks
+//	layer0    | size × (1 + M0) uint32, edges count followed by edges
+//	nodes     | size × 2 uint32, number of levels (deleted flag at high bit)
+//	          | and index of the first block at upper levels
+//	upper     | blocks × (1 + M) uint32, edges count followed by edges
+//	keys      | size × uint32
+//	vectors   | size × dim float32
+//
+// Open validates the header and the index of nodes. Edges are validated
+// lazily while the graph is traversed, corrupted blocks are skipped and
+// reported by Err.
+package mmap
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"sync"
+	"unsafe"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw"
+	"github.com/fogfish/hnsw/internal/pq"
+	"github.com/fogfish/hnsw/internal/types"
+	"github.com/fogfish/hnsw/vector"
+	surface "github.com/kshard/vector"
+)
+
+const (
+	magic      = "HNSWMMAP"
+	version    = uint32(1)
+	headerSize = 64
+	deleted    = uint32(1 << 31)
+
+	// sanity limit on number of levels per node
+	maxLevels = 64
+)
+
+// Layout of vector in the memory mapped file, vector is stored as the key
+// and fixed size sequence of float32.
+type Layout[Vector any] interface {
+	Encode(Vector) (uint32, surface.F32)
+	Decode(uint32, surface.F32) Vector
+}
+
+// Layout of vector.VF32
+var LayoutVF32 Layout[vector.VF32] = layoutVF32{}
+
+type layoutVF32 struct{}
+
+func (layoutVF32) Encode(v vector.VF32) (uint32, surface.F32) { return v.Key, v.Vec }
+
+func (layoutVF32) Decode(k uint32, v surface.F32) vector.VF32 {
+	return vector.VF32{Key: k, Vec: v}
+}
+
+//------------------------------------------------------------------------------
+
+// Write index into memory mappable layout. The index must not be modified
+// while it is written. The index with errors of fetching disk-resident
+// vectors (see hnsw.ReadLazy) is not written.
+func Write[Vector any](w io.Writer, h *hnsw.HNSW[Vector], layout Layout[Vector]) error {
+	nodes := h.Nodes()
+	if err := h.Err(); err != nil {
+		return err
+	}
+
+	var dim, m0, m, blocks int
+	for i, node := range nodes.Heap {
+		_, vec := layout.Encode(node.Vector)
+		if i == 0 {
+			dim = len(vec)
+		}
+		if len(vec) != dim {
+			return fmt.Errorf("vector %d has dimension %d, expected %d", i, len(vec), dim)
+		}
+
+		for lvl, edges := range node.Connections {
+			if lvl == 0 {
+				m0 = max(m0, len(edges))
+			} else {
+				m = max(m, len(edges))
+				blocks++
+			}
+		}
+	}
+
+	bw := bufio.NewWriter(w)
+	buf := make([]byte, 4)
+	u32 := func(v uint32) {
+		binary.LittleEndian.PutUint32(buf, v)
+		bw.Write(buf)
+	}
+
+	hdr := make([]byte, headerSize)
+	copy(hdr, magic)
+	for i, v := range []int{int(version), dim, len(nodes.Heap), int(nodes.Head), nodes.Rank, m0, m, blocks} {
+		binary.LittleEndian.PutUint32(hdr[len(magic)+4*i:], uint32(v))
+	}
+	bw.Write(hdr)
+
+	block := func(edges []hnsw.Pointer, width int) {
+		u32(uint32(len(edges)))
+		for i := 0; i < width; i++ {
+			if i < len(edges) {
+				u32(edges[i])
+			} else {
+				u32(0)
+			}
+		}
+	}
+
+	for _, node := range nodes.Heap {
+		var edges []hnsw.Pointer
+		if len(node.Connections) > 0 {
+			edges = node.Connections[0]
+		}
+		block(edges, m0)
+	}
+
+	base := 0
+	for _, node := range nodes.Heap {
+		levels := uint32(len(node.Connections))
+		if node.Deleted {
+			levels |= deleted
+		}
+		u32(levels)
+		u32(uint32(base))
+		base += max(0, len(node.Connections)-1)
+	}
+
+	for _, node := range nodes.Heap {
+		for lvl := 1; lvl < len(node.Connections); lvl++ {
+			block(node.Connections[lvl], m)
+		}
+	}
+
+	for _, node := range nodes.Heap {
+		key, _ := layout.Encode(node.Vector)
+		u32(key)
+	}
+
+	for _, node := range nodes.Heap {
+		_, vec := layout.Encode(node.Vector)
+		for _, x := range vec {
+			u32(math.Float32bits(x))
+		}
+	}
+
+	return bw.Flush()
+}
+
+//------------------------------------------------------------------------------
+
+// Read-only Hierarchical Navigable Small World Graph backed by memory
+// mapped file.
+type Index[Vector any] struct {
+	surface surface.Surface[Vector]
+	layout  Layout[Vector]
+	data    []byte
+	unmap   func([]byte) error
+
+	dim, size, m0, m int
+	head             hnsw.Pointer
+	level            int
+
+	layer0  []uint32
+	nodes   []uint32
+	upper   []uint32
+	keys    []uint32
+	vectors []float32
+
+	mu  sync.Mutex
+	err error
+}
+
+// Open memory mapped index
+func Open[Vector any](path string, surface surface.Surface[Vector], layout Layout[Vector]) (*Index[Vector], error) {
+	if !littleEndian() {
+		return nil, fmt.Errorf("memory mapped index requires little endian platform")
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	fi, err := fd.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	if fi.Size() < headerSize {
+		return nil, fmt.Errorf("%s is not memory mapped index", path)
+	}
+
+	data, unmap, err := mmap(fd, int(fi.Size()))
+	if err != nil {
+		return nil, err
+	}
+
+	idx := &Index[Vector]{
+		surface: surface,
+		layout:  layout,
+		data:    data,
+		unmap:   unmap,
+	}
+
+	if err := idx.regions(); err != nil {
+		idx.Close()
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	return idx, nil
+}
+
+// map regions of the file
+func (idx *Index[Vector]) regions() error {
+	if string(idx.data[:len(magic)]) != magic {
+		return fmt.Errorf("invalid magic")
+	}
+
+	hdr := func(i int) int {
+		return int(binary.LittleEndian.Uint32(idx.data[len(magic)+4*i:]))
+	}
+
+	if v := hdr(0); uint32(v) != version {
+		return fmt.Errorf("unsupported version %d", v)
+	}
+
+	idx.dim, idx.size = hdr(1), hdr(2)
+	idx.head, idx.level = hnsw.Pointer(hdr(3)), hdr(4)
+	idx.m0, idx.m = hdr(5), hdr(6)
+	blocks := hdr(7)
+
+	offset := headerSize
+	region := func(n int) []uint32 {
+		if n == 0 || offset+4*n > len(idx.data) {
+			offset += 4 * n
+			return nil
+		}
+		seq := unsafe.Slice((*uint32)(unsafe.Pointer(&idx.data[offset])), n)
+		offset += 4 * n
+		return seq
+	}
+
+	idx.layer0 = region(idx.size * (1 + idx.m0))
+	idx.nodes = region(idx.size * 2)
+	idx.upper = region(blocks * (1 + idx.m))
+	idx.keys = region(idx.size)
+	if vectors := region(idx.size * idx.dim); vectors != nil {
+		idx.vectors = unsafe.Slice((*float32)(unsafe.Pointer(&vectors[0])), len(vectors))
+	}
+
+	if offset != len(idx.data) {
+		return fmt.Errorf("invalid size %d, expected %d", len(idx.data), offset)
+	}
+
+	return idx.validate(blocks)
+}
+
+// validate header and index of nodes
+func (idx *Index[Vector]) validate(blocks int) error {
+	if idx.size > 0 && int(idx.head) >= idx.size {
+		return fmt.Errorf("invalid head %d", idx.head)
+	}
+
+	if idx.level > maxLevels {
+		return fmt.Errorf("invalid level %d", idx.level)
+	}
+
+	for addr := 0; addr < idx.size; addr++ {
+		levels := int(idx.nodes[2*addr] &^ deleted)
+		if levels > maxLevels {
+			return fmt.Errorf("invalid number of levels %d at node %d", levels, addr)
+		}
+
+		if levels > 1 && uint64(idx.nodes[2*addr+1])+uint64(levels-1) > uint64(blocks) {
+			return fmt.Errorf("invalid block %d at node %d", idx.nodes[2*addr+1], addr)
+		}
+	}
+
+	return nil
+}
+
+// Close index, unmapping the file
+func (idx *Index[Vector]) Close() error {
+	data := idx.data
+	idx.data = nil
+	idx.layer0, idx.nodes, idx.upper, idx.keys, idx.vectors = nil, nil, nil, nil, nil
+
+	if data == nil {
+		return nil
+	}
+
+	return idx.unmap(data)
+}
+
+func (idx *Index[Vector]) String() string {
+	return fmt.Sprintf("{ %d | Levels: %d  M: %d  M0: %d  Dim: %d }",
+		idx.size, idx.level, idx.m, idx.m0, idx.dim)
+}
+
+// Return number of vectors in the index, including deleted ones
+func (idx *Index[Vector]) Size() int { return idx.size }
+
+// Return current level
+func (idx *Index[Vector]) Level() int { return idx.level }
+
+// Err returns the first error of traversing corrupted edges.
+func (idx *Index[Vector]) Err() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	return idx.err
+}
+
+func (idx *Index[Vector]) fail(err error) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+
+	if idx.err == nil {
+		idx.err = err
+	}
+}
+
+// Return vector at the address
+func (idx *Index[Vector]) Vector(addr hnsw.Pointer) Vector {
+	vec := idx.vectors[int(addr)*idx.dim : int(addr+1)*idx.dim : int(addr+1)*idx.dim]
+	return idx.layout.Decode(idx.keys[addr], vec)
+}
+
+func (idx *Index[Vector]) isDeleted(addr hnsw.Pointer) bool {
+	return idx.nodes[2*addr]&deleted != 0
+}
+
+// edges of the node at the level, corrupted edges are skipped
+func (idx *Index[Vector]) edges(level int, addr hnsw.Pointer) []uint32 {
+	var block []uint32
+	if level == 0 {
+		at := int(addr) * (1 + idx.m0)
+		block = idx.layer0[at : at+1+idx.m0]
+	} else {
+		if int(idx.nodes[2*addr]&^deleted) <= level {
+			return nil
+		}
+		at := (int(idx.nodes[2*addr+1]) + level - 1) * (1 + idx.m)
+		block = idx.upper[at : at+1+idx.m]
+	}
+
+	if int(block[0]) >= len(block) {
+		idx.fail(fmt.Errorf("invalid number of edges %d at node %d", block[0], addr))
+		return nil
+	}
+
+	edges := block[1 : 1+block[0]]
+	for _, e := range edges {
+		if int(e) >= idx.size {
+			idx.fail(fmt.Errorf("dangling edge %d at node %d", e, addr))
+			return nil
+		}
+	}
+
+	return edges
+}
+
+// Search K-nearest vectors from the graph. Results are sorted nearest-first.
+func (idx *Index[Vector]) Search(q Vector, K int, efSearch int) []hnsw.Neighbor[Vector] {
+	if idx.size == 0 {
+		return nil
+	}
+
+	head := idx.head
+	for lvl := idx.level - 1; lvl >= 0; lvl-- {
+		head = idx.skip(lvl, head, q)
+	}
+
+	w := idx.searchLayer(head, q, efSearch)
+	for w.Len() > K {
+		w.Deq()
+	}
+
+	seq := make([]hnsw.Neighbor[Vector], w.Len())
+	for i := w.Len() - 1; i >= 0; i-- {
+		x := w.Deq()
+		seq[i] = hnsw.Neighbor[Vector]{
+			Vector:   idx.Vector(x.Addr),
+			Distance: x.Distance,
+			Pointer:  x.Addr,
+		}
+	}
+
+	return seq
+}
+
+// skip the graph to "nearest" node
+func (idx *Index[Vector]) skip(level int, addr hnsw.Pointer, q Vector) hnsw.Pointer {
+	dist := idx.surface.Distance(idx.Vector(addr), q)
+
+	for {
+		next := addr
+		for _, e := range idx.edges(level, addr) {
+			if d := idx.surface.Distance(idx.Vector(e), q); d < dist {
+				dist = d
+				next = e
+			}
+		}
+
+		if next == addr {
+			return addr
+		}
+		addr = next
+	}
+}
+
+// search "nearest" vectors on the layer 0, deleted nodes are traversed but
+// never admitted into results.
+func (idx *Index[Vector]) searchLayer(addr hnsw.Pointer, q Vector, ef int) pq.Queue[types.Vertex] {
+	visited := bitset.New(uint(idx.size))
+	visited.Set(uint(addr))
+
+	this := types.Vertex{
+		Distance: idx.surface.Distance(idx.Vector(addr), q),
+		Addr:     addr,
+	}
+
+	candidates := pq.New(types.OrdForwardVertex, this)
+	setadidnac := pq.New(types.OrdReverseVertex)
+	if !idx.isDeleted(addr) {
+		setadidnac.Enq(this)
+	}
+
+	for candidates.Len() > 0 {
+		c := candidates.Deq()
+
+		if setadidnac.Len() >= ef && c.Distance > setadidnac.Head().Distance {
+			break
+		}
+
+		for _, e := range idx.edges(0, c.Addr) {
+			if !visited.Test(uint(e)) {
+				visited.Set(uint(e))
+
+				dist := idx.surface.Distance(idx.Vector(e), q)
+				item := types.Vertex{Distance: dist, Addr: e}
+
+				if setadidnac.Len() < ef || dist < setadidnac.Head().Distance {
+					if !idx.isDeleted(e) {
+						setadidnac.Enq(item)
+						if setadidnac.Len() > ef {
+							setadidnac.Deq()
+						}
+					}
+					candidates.Enq(item)
+				}
+			}
+		}
+	}
+
+	return setadidnac
+}
+
+func littleEndian() bool {
+	x := uint16(1)
+	return *(*byte)(unsafe.Pointer(&x)) == 1
+}
@@ -0,0 +1,26 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+//go:build !unix
+
+package mmap
+
+import (
+	"io"
+	"os"
+)
+
+// memory mapping is not supported, the file is read into memory
+func mmap(fd *os.File, size int) ([]byte, func([]byte) error, error) {
+	data := make([]byte, size)
+	if _, err := io.ReadFull(fd, data); err != nil {
+		return nil, nil, err
+	}
+
+	return data, func([]byte) error { return nil }, nil
+}
@@ -0,0 +1,140 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package mmap_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/fogfish/hnsw"
+	"github.com/fogfish/hnsw/mmap"
+	"github.com/fogfish/hnsw/vector"
+	surface "github.com/kshard/vector"
+)
+
+func TestMmap(t *testing.T) {
+	rnd := rand.New(rand.NewSource(0x211111111))
+	index := hnsw.New(
+		vector.SurfaceVF32(surface.Euclidean()),
+		hnsw.WithRandomSource(rnd),
+	)
+
+	for i := 0; i < 1000; i++ {
+		v := make(surface.F32, 32)
+		for j := range v {
+			v[j] = 2*rnd.Float32() - 1
+		}
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+	index.Delete(index.Head())
+
+	file := filepath.Join(t.TempDir(), "index.mmap")
+	fd, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := mmap.Write(fd, index, mmap.LayoutVF32); err != nil {
+		t.Fatal(err)
+	}
+	fd.Close()
+
+	mapped, err := mmap.Open(file, vector.SurfaceVF32(surface.Euclidean()), mmap.LayoutVF32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mapped.Close()
+
+	if mapped.Size() != index.Size() || mapped.Level() != index.Level() {
+		t.Errorf("Not equal %s and %s", mapped, index)
+	}
+
+	index.ForAll(0,
+		func(rank int, q vector.VF32, edges []vector.VF32) error {
+			expect := index.SearchWithDistance(q, 5, 100)
+			seq := mapped.Search(q, 5, 100)
+			if len(seq) != 5 || seq[0].Vector.Key != q.Key {
+				t.Errorf("Not found %v in %v", q, seq)
+			}
+
+			for i := range seq {
+				if seq[i].Pointer != expect[i].Pointer || seq[i].Distance != expect[i].Distance {
+					t.Errorf("Not equal %v and %v", seq[i], expect[i])
+				}
+			}
+			return nil
+		},
+	)
+
+	if err := mapped.Err(); err != nil {
+		t.Errorf("Unexpected error %v", err)
+	}
+
+	// Corruption
+	data, err := os.ReadFile(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	corrupt := func(f func(data []byte)) string {
+		file := filepath.Join(t.TempDir(), "corrupted.mmap")
+		b := bytes.Clone(data)
+		f(b)
+		if err := os.WriteFile(file, b, 0644); err != nil {
+			t.Fatal(err)
+		}
+		return file
+	}
+
+	size := int(binary.LittleEndian.Uint32(data[16:]))
+	m0 := int(binary.LittleEndian.Uint32(data[28:]))
+	nodes := 64 + 4*size*(1+m0)
+
+	head := corrupt(func(b []byte) { binary.LittleEndian.PutUint32(b[20:], uint32(size)) })
+	if _, err := mmap.Open(head, vector.SurfaceVF32(surface.Euclidean()), mmap.LayoutVF32); err == nil {
+		t.Errorf("Invalid head is not detected")
+	}
+
+	upper := corrupt(func(b []byte) {
+		for addr := 0; addr < size; addr++ {
+			binary.LittleEndian.PutUint32(b[nodes+8*addr+4:], 0xffffff)
+		}
+	})
+	if _, err := mmap.Open(upper, vector.SurfaceVF32(surface.Euclidean()), mmap.LayoutVF32); err == nil {
+		t.Errorf("Invalid upper block is not detected")
+	}
+
+	edges := corrupt(func(b []byte) {
+		for addr := 0; addr < size; addr++ {
+			binary.LittleEndian.PutUint32(b[64+4*addr*(1+m0):], uint32(m0+1))
+		}
+	})
+	broken, err := mmap.Open(edges, vector.SurfaceVF32(surface.Euclidean()), mmap.LayoutVF32)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer broken.Close()
+
+	broken.Search(vector.VF32{Vec: make(surface.F32, 32)}, 5, 100)
+	if broken.Err() == nil {
+		t.Errorf("Invalid edges are not detected")
+	}
+
+	if err := os.Truncate(file, 1024); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := mmap.Open(file, vector.SurfaceVF32(surface.Euclidean()), mmap.LayoutVF32); err == nil {
+		t.Errorf("Truncation is not detected")
+	}
+}
@@ -27,6 +27,23 @@ type Config struct {
 	// Normalization factor for level generation
 	mL float64
 
+	// Neighbor selection heuristic
+	heuristic             bool
+	extendCandidates      bool
+	keepPrunedConnections bool
+
+	// Selectivity of filter that triggers brute force search
+	filterThreshold float64
+
+	// Write-ahead log
+	wal *WAL
+
+	// Codec of vectors, Codec[Vector]
+	codec any
+
+	// Migrations of persisted index
+	migrations []Migration
+
 	//
 	random rand.Source
 }
@@ -111,6 +128,43 @@ func WithDefaultL() Option {
 	}
 }
 
+// Neighbor Selection Heuristic
+//
+// By default, the node is connected to M nearest candidates. On clustered
+// data it yields poorly connected clusters. The heuristic (Algorithm 4 of
+// the original publication) selects candidate only if it is closer to the
+// node than to any of already selected neighbors, creating connections in
+// diverse directions. The heuristic is used both for edges of new node and
+// for shrinking neighbor lists.
+func WithHeuristic() Option {
+	return func(c *Config) {
+		c.heuristic = true
+	}
+}
+
+// Extend Candidates of Neighbor Selection Heuristic
+//
+// Extends the set of candidates with their own neighbors. It is useful for
+// extremely clustered data. The option enables the heuristic.
+func WithExtendCandidates() Option {
+	return func(c *Config) {
+		c.heuristic = true
+		c.extendCandidates = true
+	}
+}
+
+// Keep Pruned Connections of Neighbor Selection Heuristic
+//
+// Fills the neighbor list up to M using nearest candidates discarded by
+// the heuristic, so that nodes maintain the fixed number of connections.
+// The option enables the heuristic.
+func WithKeepPrunedConnections() Option {
+	return func(c *Config) {
+		c.heuristic = true
+		c.keepPrunedConnections = true
+	}
+}
+
 // Random Source
 //
 // Uniform random source for seeding exponential distribution.
@@ -120,6 +174,65 @@ func WithRandomSource(random rand.Source) Option {
 	}
 }
 
+// Filter Selectivity Threshold
+//
+// The filtered search traverses the graph through nodes rejected by the
+// filter. It becomes inefficient if the filter accepts only a tiny fraction
+// of nodes. The search falls back to brute force scan of the heap if the
+// estimated fraction of accepted nodes is below the threshold.
+//
+// Typical values range from 0.001 to 0.05 (default 0.01).
+func WithFilterThreshold(ratio float64) Option {
+	return func(c *Config) {
+		c.filterThreshold = ratio
+	}
+}
+
+// Write-Ahead Log
+//
+// Records every insert and delete into the append-only log, so that changes
+// made after the last Write are recovered after the crash using Recover.
+// The log is truncated by Write and WriteDelta. The log is owned by
+// the application, which closes it.
+func WithWAL(wal *WAL) Option {
+	return func(c *Config) {
+		c.wal = wal
+	}
+}
+
+// Vector Codec
+//
+// Encodes vectors for Write, Read, WriteTo, ReadFrom and the write-ahead log
+// instead of reflection, which is slow and fails on interface typed
+// attributes. The codec must support the vector type of the index, see
+// package vector for built-in codecs.
+//
+//	hnsw.New(vector.SurfaceVF32(surface.Cosine()),
+//		hnsw.WithCodec[vector.VF32](vector.CodecVF32{}),
+//	)
+//
+// The index must be read using the same codec as it was written.
+func WithCodec[Vector any](codec Codec[Vector]) Option {
+	return func(c *Config) {
+		c.codec = codec
+	}
+}
+
+// Migration of Persisted Index
+//
+// Read validates metadata of the persisted index (format version, vector
+// type, surface and codec). Migrations are applied in the given order if
+// the index is written by older version of the format or it is incompatible
+// with the reader (e.g. vector type is changed). Each migration receives
+// metadata of the persisted index and returns the reader of upgraded one,
+// Read fails if the upgraded index remains incompatible. Legacy layout
+// without metadata is readable without migrations.
+func WithMigration(migrations ...Migration) Option {
+	return func(c *Config) {
+		c.migrations = append(c.migrations, migrations...)
+	}
+}
+
 // Default options
 func WithDefault() Option {
 	return With(
@@ -127,6 +240,7 @@ func WithDefault() Option {
 		WithM(16),
 		WithDefaultM0(),
 		WithDefaultL(),
+		WithFilterThreshold(0.01),
 		WithRandomSource(rand.NewSource(time.Now().UnixNano())),
 	)
 }
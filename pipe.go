@@ -8,24 +8,125 @@
 
 package hnsw
 
-// Create pipe ("channel") for  batch insert
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+// Error returned when vector is sent to closed pipe
+var ErrClosed = errors.New("pipe is closed")
+
+// Pipe for batch insert, vectors are inserted by the pool of workers.
+type Pipe[Vector any] struct {
+	rw       sync.RWMutex
+	wg       sync.WaitGroup
+	ctx      context.Context
+	ch       chan Vector
+	closed   bool
+	sent     atomic.Int64
+	inserted atomic.Int64
+}
+
+// Create pipe for batch insert
 //
-//	ch := index.Pipe(runtime.NumCPU())
-//	ch <- vector.VF32{Key: 1, Vec: []float32{0.1, 0.2, /* ... */ 0.128}}
+//	pipe := index.Pipe(runtime.NumCPU())
+//	pipe.Send(vector.VF32{Key: 1, Vec: []float32{0.1, 0.2, /* ... */ 0.128}})
+//	pipe.Close()
 //
 // The HNSW library supports batch insert operations, making it efficient to
 // add large datasets. It leverages Golang channels to handle parallel writes,
 // ensuring that multiple data points can be inserted concurrently.
-func (h *HNSW[Vector]) Pipe(workers int) chan<- Vector {
-	pipe := make(chan Vector, workers)
+func (h *HNSW[Vector]) Pipe(workers int) *Pipe[Vector] {
+	return h.PipeContext(context.Background(), workers, nil)
+}
+
+// Create pipe for batch insert, bound to the context. The pipe discards
+// pending vectors if the context is cancelled. The progress callback
+// (optional) is called by workers after each insert with the total number
+// of inserted vectors, it must be safe for concurrent use.
+func (h *HNSW[Vector]) PipeContext(ctx context.Context, workers int, progress func(int)) *Pipe[Vector] {
+	return newPipe(ctx, workers, h.Insert, progress)
+}
 
+func newPipe[Vector any](ctx context.Context, workers int, insert func(Vector), progress func(int)) *Pipe[Vector] {
+	pipe := &Pipe[Vector]{
+		ctx: ctx,
+		ch:  make(chan Vector, workers),
+	}
+
+	pipe.wg.Add(workers)
 	for i := 1; i <= workers; i++ {
 		go func() {
-			for v := range pipe {
-				h.Insert(v)
+			defer pipe.wg.Done()
+
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case v, ok := <-pipe.ch:
+					if !ok || ctx.Err() != nil {
+						return
+					}
+
+					insert(v)
+					n := pipe.inserted.Add(1)
+					if progress != nil {
+						progress(int(n))
+					}
+				}
 			}
 		}()
 	}
 
 	return pipe
 }
+
+// Send vector to the pipe, it blocks until one of workers accepts it.
+func (p *Pipe[Vector]) Send(v Vector) error {
+	p.rw.RLock()
+	defer p.rw.RUnlock()
+
+	if p.closed {
+		return ErrClosed
+	}
+
+	if err := p.ctx.Err(); err != nil {
+		return err
+	}
+
+	select {
+	case <-p.ctx.Done():
+		return p.ctx.Err()
+	case p.ch <- v:
+		p.sent.Add(1)
+		return nil
+	}
+}
+
+// Close the pipe and wait until all sent vectors are inserted. It returns
+// the context error if pipe is cancelled before all sent vectors are inserted.
+func (p *Pipe[Vector]) Close() error {
+	p.rw.Lock()
+	if !p.closed {
+		p.closed = true
+		close(p.ch)
+	}
+	p.rw.Unlock()
+
+	p.wg.Wait()
+
+	if p.inserted.Load() < p.sent.Load() {
+		return p.ctx.Err()
+	}
+
+	return nil
+}
+
+// Wait until workers are terminated either due to Close or cancellation
+// of the context.
+func (p *Pipe[Vector]) Wait() { p.wg.Wait() }
+
+// Number of inserted vectors
+func (p *Pipe[Vector]) Inserted() int { return int(p.inserted.Load()) }
@@ -0,0 +1,87 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"context"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw/internal/pq"
+	"github.com/fogfish/hnsw/internal/types"
+)
+
+// Search all vectors within the distance r from the query.
+//
+// The search locates the beam of efSearch nearest nodes at layer 0 and
+// expands it while neighbors fall inside the radius. The limit caps number
+// of results to bound the runtime, use 0 for unlimited search. Results are
+// sorted nearest-first.
+//
+//	for _, x := range index.SearchRadius(query, 0.05, 100, 0) {
+//		// x.Vector is a duplicate of query
+//	}
+func (h *HNSW[Vector]) SearchRadius(q Vector, r float32, efSearch int, limit int) []Neighbor[Vector] {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	h.rwCore.RLock()
+	head := h.head
+	hLevel := h.level
+	h.rwCore.RUnlock()
+
+	for lvl := hLevel - 1; lvl >= 0; lvl-- {
+		head = h.skip(lvl, head, q)
+	}
+
+	w := h.searchLayer(context.Background(), 0, head, q, efSearch, nil)
+
+	visited := bitset.New(uint(efSearch))
+	candidates := pq.New(types.OrdForwardVertex)
+	for w.Len() > 0 {
+		x := w.Deq()
+		visited.Set(uint(x.Addr))
+		if x.Distance <= r {
+			candidates.Enq(x)
+		}
+	}
+
+	result := pq.New(types.OrdReverseVertex)
+	for candidates.Len() > 0 {
+		c := candidates.Deq()
+
+		cnode := h.node(c.Addr)
+		cedge := cnode.Connections[0]
+
+		if !cnode.Deleted {
+			result.Enq(c)
+			if limit > 0 && result.Len() >= limit {
+				break
+			}
+		}
+
+		h.prefetch(cedge)
+		for _, e := range cedge {
+			if !visited.Test(uint(e)) {
+				visited.Set(uint(e))
+
+				ev, ok := h.load(e)
+				if !ok {
+					continue
+				}
+
+				dist := h.surface.Distance(ev, q)
+				if dist <= r {
+					candidates.Enq(types.Vertex{Distance: dist, Addr: e})
+				}
+			}
+		}
+	}
+
+	return h.neighbors(result)
+}
@@ -0,0 +1,103 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"context"
+	"slices"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/hnsw/internal/types"
+)
+
+// Repair reconnects nodes unreachable from the head at level 0.
+//
+// New nodes might end up disconnected from the graph (e.g. after heavy
+// concurrent inserts or deletes), so that the search never returns them.
+// The node is re-linked to neighbors found by the search, neighbors receive
+// reciprocal edges to the node. Nodes reachable through re-linked ones are
+// not re-linked. The index is blocked while it is repaired.
+//
+// It returns number of re-linked nodes, see Stats for detection of
+// unreachable nodes.
+func (h *HNSW[Vector]) Repair() int {
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	if len(h.heap) == 0 {
+		return 0
+	}
+
+	var reachable bitset.BitSet
+	h.forNode(0, h.head, &reachable, nil)
+
+	fixed := 0
+	for addr := range h.heap {
+		if h.heap[addr].Deleted || reachable.Test(uint(addr)) {
+			continue
+		}
+
+		if h.relink(Pointer(addr)) {
+			fixed++
+			h.forNode(0, Pointer(addr), &reachable, nil)
+		}
+	}
+
+	return fixed
+}
+
+// link the node with its neighbors at level 0 using reciprocal edges
+func (h *HNSW[Vector]) relink(addr Pointer) bool {
+	v := h.vector(addr)
+
+	head := h.head
+	for lvl := h.level - 1; lvl > 0; lvl-- {
+		head = h.skip(lvl, head, v)
+	}
+
+	w := h.searchLayer(context.Background(), 0, head, v, h.config.efConstruction, nil)
+	candidates := make([]types.Vertex, 0, w.Len())
+	for _, c := range drain(w) {
+		if c.Addr != addr && !h.deleted(c.Addr) {
+			candidates = append(candidates, c)
+		}
+	}
+
+	edges := h.selectNeighbors(0, v, candidates, h.config.mLayer0, addr)
+	if len(edges) == 0 {
+		return false
+	}
+
+	for _, e := range edges {
+		h.addConnection(0, e, addr)
+		h.shrinkConnections(0, e, addr)
+	}
+
+	// existing edges of the node are kept if there is a room
+	node := h.heap[addr]
+	if len(node.Connections) == 0 {
+		node.Connections = make([][]Pointer, 1)
+	}
+
+	conns := slices.Clone(edges)
+	for _, e := range node.Connections[0] {
+		if len(conns) < h.config.mLayer0 && !slices.Contains(conns, e) {
+			conns = append(conns, e)
+		}
+	}
+	node.Connections[0] = conns
+
+	slot := addr % heapRWSlots
+	h.rwHeap[slot].Lock()
+	h.heap[addr] = node
+	h.rwHeap[slot].Unlock()
+	h.touch(addr)
+
+	return true
+}
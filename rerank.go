@@ -0,0 +1,74 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"cmp"
+	"context"
+	"slices"
+)
+
+// Search K-nearest vectors from the graph, rescoring top efSearch
+// candidates with the rerank function. Results are sorted nearest-first.
+//
+// The graph of compressed (e.g. quantized) vectors is traversed using
+// approximate distances, the rerank function computes precise distance from
+// the query to the vector (e.g. using original float32 vectors).
+//
+//	index.SearchRerank(query, 10, 100,
+//		vector.RerankVI8(store, surface.Cosine(), original),
+//	)
+func (h *HNSW[Vector]) SearchRerank(q Vector, K int, efSearch int, rerank func(Vector) (float32, error)) ([]Neighbor[Vector], error) {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	seq := h.neighbors(h.search(context.Background(), q, max(K, efSearch), max(K, efSearch), nil))
+
+	return rescore(seq, K, rerank)
+}
+
+// Search K·factor nearest candidates from the graph, reranking them with
+// the rerank function. Results are sorted nearest-first.
+//
+// The oversampling compensates the loss of precision by coarse compression
+// (e.g. binary quantization), typical factor ranges from 2 to 10.
+//
+//	index.SearchOversample(vector.BinaryVF32(query), 10, 4, 100,
+//		vector.RerankVBits(store, surface.Cosine(), query.Vec),
+//	)
+func (h *HNSW[Vector]) SearchOversample(q Vector, K int, factor int, efSearch int, rerank func(Vector) (float32, error)) ([]Neighbor[Vector], error) {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	n := K * max(factor, 1)
+	seq := h.neighbors(h.search(context.Background(), q, n, max(n, efSearch), nil))
+
+	return rescore(seq, K, rerank)
+}
+
+// rescore neighbors with precise distance, keeping K nearest ones
+func rescore[Vector any](seq []Neighbor[Vector], K int, rerank func(Vector) (float32, error)) ([]Neighbor[Vector], error) {
+	for i := range seq {
+		d, err := rerank(seq[i].Vector)
+		if err != nil {
+			return nil, err
+		}
+		seq[i].Distance = d
+	}
+
+	slices.SortStableFunc(seq,
+		func(a, b Neighbor[Vector]) int { return cmp.Compare(a.Distance, b.Distance) },
+	)
+
+	if len(seq) > K {
+		seq = seq[:K]
+	}
+
+	return seq, nil
+}
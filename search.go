@@ -9,6 +9,9 @@
 package hnsw
 
 import (
+	"context"
+	"math"
+
 	"github.com/bits-and-blooms/bitset"
 	"github.com/fogfish/hnsw/internal/pq"
 	"github.com/fogfish/hnsw/internal/types"
@@ -28,11 +31,20 @@ func (h *HNSW[Vector]) skip(level int, addr Pointer, q Vector) Pointer {
 // skip to "nearest" connection at the node.
 // it return input address if no "movements" is possible
 func (h *HNSW[Vector]) skipToNearest(level int, addr Pointer, q Vector) Pointer {
-	node := h.heap[addr]
-	dist := h.surface.Distance(node.Vector, q)
+	node := h.node(addr)
+	dist := float32(math.MaxFloat32)
+	if v, ok := h.load(addr); ok {
+		dist = h.surface.Distance(v, q)
+	}
 
+	h.prefetch(node.Connections[level])
 	for _, a := range node.Connections[level] {
-		d := h.surface.Distance(h.heap[a].Vector, q)
+		v, ok := h.load(a)
+		if !ok {
+			continue
+		}
+
+		d := h.surface.Distance(v, q)
 		if d < dist {
 			dist = d
 			addr = a
@@ -42,48 +54,66 @@ func (h *HNSW[Vector]) skipToNearest(level int, addr Pointer, q Vector) Pointer
 	return addr
 }
 
-// search "nearest" vectors on the layer
-func (h *HNSW[Vector]) searchLayer(level int, addr Pointer, q Vector, ef int) pq.Queue[types.Vertex] {
+// search "nearest" vectors on the layer.
+// Deleted nodes and nodes rejected by the filter (if defined) are traversed
+// but never admitted into results. The search is interrupted when context is
+// done, returning the best results found so far.
+func (h *HNSW[Vector]) searchLayer(ctx context.Context, level int, addr Pointer, q Vector, ef int, filter func(Pointer, Vector) bool) pq.Queue[types.Vertex] {
+	done := ctx.Done()
 	visited := bitset.New(uint(ef))
 	visited.Set(uint(addr))
 
-	this := types.Vertex{
-		Distance: h.surface.Distance(h.heap[addr].Vector, q),
-		Addr:     addr,
+	// entry point is traversed even if its vector is failed to fetch
+	this := types.Vertex{Distance: math.MaxFloat32, Addr: addr}
+	v, ok := h.load(addr)
+	if ok {
+		this.Distance = h.surface.Distance(v, q)
 	}
 
 	candidates := pq.New(types.OrdForwardVertex, this)
-	setadidnac := pq.New(types.OrdReverseVertex, this)
+	setadidnac := pq.New(types.OrdReverseVertex)
+	if ok && h.admit(addr, v, filter) {
+		setadidnac.Enq(this)
+	}
 
 	for candidates.Len() > 0 {
+		select {
+		case <-done:
+			return setadidnac
+		default:
+		}
+
 		c := candidates.Deq()
-		f := setadidnac.Head()
 
-		if c.Distance > f.Distance {
+		if setadidnac.Len() >= ef && c.Distance > setadidnac.Head().Distance {
 			break
 		}
 
-		slot := c.Addr % heapRWSlots
-		h.rwHeap[slot].RLock()
-		cnode := h.heap[c.Addr]
-		cedge := cnode.Connections[level]
-		h.rwHeap[slot].RUnlock()
+		cedge := h.links(c.Addr, level)
 
+		h.prefetch(cedge)
 		for _, e := range cedge {
 			if !visited.Test(uint(e)) {
 				visited.Set(uint(e))
 
-				dist := h.surface.Distance(h.heap[e].Vector, q)
+				ev, ok := h.load(e)
+				if !ok {
+					continue
+				}
+
+				dist := h.surface.Distance(ev, q)
 				item := types.Vertex{Distance: dist, Addr: e}
 
 				if setadidnac.Len() < ef {
-					if e != addr {
+					if h.admit(e, ev, filter) {
 						setadidnac.Enq(item)
 					}
 					candidates.Enq(item)
 				} else if dist < setadidnac.Head().Distance {
-					setadidnac.Enq(item)
-					setadidnac.Deq()
+					if h.admit(e, ev, filter) {
+						setadidnac.Enq(item)
+						setadidnac.Deq()
+					}
 					candidates.Enq(item)
 				}
 			}
@@ -93,9 +123,66 @@ func (h *HNSW[Vector]) searchLayer(level int, addr Pointer, q Vector, ef int) pq
 	return setadidnac
 }
 
+// admit node into search results
+func (h *HNSW[Vector]) admit(addr Pointer, v Vector, filter func(Pointer, Vector) bool) bool {
+	return !h.deleted(addr) && (filter == nil || filter(addr, v))
+}
+
 // Search K-nearest vectors from the graph
 func (h *HNSW[Vector]) Search(q Vector, K int, efSearch int) []Vector {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	w := h.search(context.Background(), q, K, efSearch, nil)
+
+	return h.vectors(w)
+}
+
+// Search K-nearest vectors from the graph within the context.
+//
+// The search is interrupted if the context is done (e.g. deadline is hit).
+// It returns the best results found so far together with the context error,
+// so that caller decides either to use partial results or fail.
+//
+//	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+//	defer cancel()
+//
+//	neighbors, err := index.SearchContext(ctx, query, 10, 100)
+//	if errors.Is(err, context.DeadlineExceeded) {
+//		// neighbors are partial
+//	}
+func (h *HNSW[Vector]) SearchContext(ctx context.Context, q Vector, K int, efSearch int) ([]Vector, error) {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+
+	w := h.search(ctx, q, K, efSearch, nil)
+
+	return h.vectors(w), ctx.Err()
+}
+
+// Search K-nearest vectors from the graph, annotating them with
+// the distance to query and the address of node. Results are sorted
+// nearest-first.
+//
+//	for _, x := range index.SearchWithDistance(query, 10, 100) {
+//		if x.Distance < 0.2 {
+//			// do something
+//		}
+//	}
+func (h *HNSW[Vector]) SearchWithDistance(q Vector, K int, efSearch int) []Neighbor[Vector] {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	w := h.search(context.Background(), q, K, efSearch, nil)
+
+	return h.neighbors(w)
+}
 
+func (h *HNSW[Vector]) search(ctx context.Context, q Vector, K int, efSearch int, filter func(Pointer, Vector) bool) pq.Queue[types.Vertex] {
 	h.rwCore.RLock()
 	head := h.head
 	hLevel := h.level
@@ -105,16 +192,36 @@ func (h *HNSW[Vector]) Search(q Vector, K int, efSearch int) []Vector {
 		head = h.skip(lvl, head, q)
 	}
 
-	w := h.searchLayer(0, head, q, efSearch)
+	w := h.searchLayer(ctx, 0, head, q, efSearch, filter)
 	for w.Len() > K {
 		w.Deq()
 	}
 
+	return w
+}
+
+// drain queue of vertices (furthest first) into nearest-first vectors
+func (h *HNSW[Vector]) vectors(w pq.Queue[types.Vertex]) []Vector {
 	v := make([]Vector, w.Len())
 	for i := w.Len() - 1; i >= 0; i-- {
 		x := w.Deq()
-		v[i] = h.heap[x.Addr].Vector
+		v[i] = h.vector(x.Addr)
 	}
 
 	return v
 }
+
+// drain queue of vertices (furthest first) into nearest-first neighbors
+func (h *HNSW[Vector]) neighbors(w pq.Queue[types.Vertex]) []Neighbor[Vector] {
+	seq := make([]Neighbor[Vector], w.Len())
+	for i := w.Len() - 1; i >= 0; i-- {
+		x := w.Deq()
+		seq[i] = Neighbor[Vector]{
+			Vector:   h.vector(x.Addr),
+			Distance: x.Distance,
+			Pointer:  x.Addr,
+		}
+	}
+
+	return seq
+}
@@ -0,0 +1,160 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/bits-and-blooms/bitset"
+)
+
+// Health report of the graph, see Stats
+type Stats struct {
+	// Number of nodes in the heap, including deleted ones
+	Size int
+
+	// Number of deleted nodes
+	Deleted int
+
+	// Number of alive nodes with empty adjacency at level 0
+	Isolated int
+
+	// Statistics per level, starting from level 0
+	Levels []LevelStats
+}
+
+// Statistics of the graph level, deleted nodes are not counted.
+type LevelStats struct {
+	// Number of nodes linked at the level
+	Nodes int
+
+	// Number of nodes unreachable from the head
+	Unreachable int
+
+	// Fraction of nodes with full neighbor list (M or M0 connections)
+	Saturated float64
+
+	// Histogram of out-degree, OutDegree[d] is number of nodes with d edges
+	OutDegree []int
+
+	// Histogram of in-degree, InDegree[d] is number of nodes referenced by
+	// d edges of other nodes
+	InDegree []int
+}
+
+func (s Stats) String() string {
+	var sb strings.Builder
+
+	sb.WriteString(fmt.Sprintf("{ %d | Deleted: %d  Isolated: %d }\n", s.Size, s.Deleted, s.Isolated))
+	for lvl, l := range s.Levels {
+		sb.WriteString(fmt.Sprintf("  %d: Nodes: %d  Unreachable: %d  Saturated: %.2f\n", lvl, l.Nodes, l.Unreachable, l.Saturated))
+	}
+
+	return sb.String()
+}
+
+// Stats returns health report of the graph: number of nodes per level,
+// degree distributions, unreachable and isolated nodes. Degraded graph (e.g.
+// after heavy concurrent inserts or deletes) has unreachable nodes, which are
+// never returned by the search, see Repair.
+//
+// Concurrent writes are blocked until the report is ready.
+func (h *HNSW[Vector]) Stats() Stats {
+	h.rwCompact.RLock()
+	defer h.rwCompact.RUnlock()
+
+	h.rwCore.RLock()
+	defer h.rwCore.RUnlock()
+
+	for i := 0; i < heapRWSlots; i++ {
+		h.rwHeap[i].RLock()
+		defer h.rwHeap[i].RUnlock()
+	}
+
+	stats := Stats{Size: len(h.heap)}
+
+	levels := 0
+	for _, node := range h.heap {
+		levels = max(levels, len(node.Connections))
+
+		switch {
+		case node.Deleted:
+			stats.Deleted++
+		case len(node.Connections) == 0 || len(node.Connections[0]) == 0:
+			stats.Isolated++
+		}
+	}
+
+	stats.Levels = make([]LevelStats, levels)
+	for lvl := range stats.Levels {
+		stats.Levels[lvl] = h.levelStats(lvl)
+	}
+
+	return stats
+}
+
+func (h *HNSW[Vector]) levelStats(level int) LevelStats {
+	var stats LevelStats
+
+	var reachable bitset.BitSet
+	if len(h.heap) > 0 {
+		h.forNode(level, h.head, &reachable, nil)
+	}
+
+	m := h.config.mLayerN
+	if level == 0 {
+		m = h.config.mLayer0
+	}
+
+	saturated := 0
+	indegree := make([]int, len(h.heap))
+	for addr, node := range h.heap {
+		if node.Deleted || len(node.Connections) <= level {
+			continue
+		}
+
+		edges := node.Connections[level]
+		for _, e := range edges {
+			if !h.heap[e].Deleted {
+				indegree[e]++
+			}
+		}
+
+		stats.Nodes++
+		stats.OutDegree = histogram(stats.OutDegree, len(edges))
+		if len(edges) >= m {
+			saturated++
+		}
+
+		if !reachable.Test(uint(addr)) {
+			stats.Unreachable++
+		}
+	}
+
+	for addr, node := range h.heap {
+		if !node.Deleted && len(node.Connections) > level {
+			stats.InDegree = histogram(stats.InDegree, indegree[addr])
+		}
+	}
+
+	if stats.Nodes > 0 {
+		stats.Saturated = float64(saturated) / float64(stats.Nodes)
+	}
+
+	return stats
+}
+
+func histogram(seq []int, x int) []int {
+	if x >= len(seq) {
+		seq = append(seq, make([]int, x-len(seq)+1)...)
+	}
+	seq[x]++
+	return seq
+}
@@ -0,0 +1,112 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package store
+
+import (
+	"encoding/hex"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/fogfish/hnsw"
+)
+
+// Key/value storage at the directory, a file per key. The file is named by
+// hex encoded key. The value is written into the temporary file, which is
+// renamed, so that readers never observe partially written value. Batches are
+// not supported, the index is not written atomically (see package docs).
+type Dir struct {
+	path string
+}
+
+var _ hnsw.Scanner = (*Dir)(nil)
+
+// Create key/value storage at the directory, the directory is created
+// if it does not exist.
+func NewDir(path string) (*Dir, error) {
+	if err := os.MkdirAll(path, 0755); err != nil {
+		return nil, err
+	}
+
+	return &Dir{path: path}, nil
+}
+
+func (d *Dir) file(key []byte) string {
+	return filepath.Join(d.path, hex.EncodeToString(key))
+}
+
+func (d *Dir) Get(key []byte) ([]byte, error) {
+	val, err := os.ReadFile(d.file(key))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+
+	return val, err
+}
+
+func (d *Dir) Put(key, val []byte) error {
+	fd, err := os.CreateTemp(d.path, ".put-*")
+	if err != nil {
+		return err
+	}
+
+	_, err = fd.Write(val)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(fd.Name(), d.file(key))
+	}
+	if err != nil {
+		os.Remove(fd.Name())
+		return err
+	}
+
+	return nil
+}
+
+func (d *Dir) Scan(prefix []byte, f func(key, val []byte) error) error {
+	files, err := os.ReadDir(d.path)
+	if err != nil {
+		return err
+	}
+
+	hprefix := hex.EncodeToString(prefix)
+	for _, file := range files {
+		name := file.Name()
+		if file.IsDir() || !strings.HasPrefix(name, hprefix) {
+			continue
+		}
+
+		// temporary files are not hex encoded
+		key, err := hex.DecodeString(name)
+		if err != nil {
+			continue
+		}
+
+		val, err := os.ReadFile(filepath.Join(d.path, name))
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+
+		if err := f(key, val); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,113 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package store
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/fogfish/hnsw"
+)
+
+// In-memory key/value storage, safe for concurrent use.
+// Batches are applied atomically.
+type Memory struct {
+	mu sync.RWMutex
+	kv map[string][]byte
+}
+
+var (
+	_ hnsw.BatchWriter = (*Memory)(nil)
+	_ hnsw.BatchReader = (*Memory)(nil)
+	_ hnsw.Scanner     = (*Memory)(nil)
+)
+
+// Create in-memory key/value storage
+func NewMemory() *Memory {
+	return &Memory{kv: make(map[string][]byte)}
+}
+
+// Number of keys in the storage
+func (m *Memory) Len() int {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return len(m.kv)
+}
+
+func (m *Memory) Get(key []byte) ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return m.kv[string(key)], nil
+}
+
+func (m *Memory) GetBatch(keys [][]byte) ([][]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	vals := make([][]byte, len(keys))
+	for i, key := range keys {
+		vals[i] = m.kv[string(key)]
+	}
+
+	return vals, nil
+}
+
+func (m *Memory) Put(key, val []byte) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.kv[string(key)] = bytes.Clone(val)
+	return nil
+}
+
+func (m *Memory) Scan(prefix []byte, f func(key, val []byte) error) error {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	for key, val := range m.kv {
+		if len(key) >= len(prefix) && key[:len(prefix)] == string(prefix) {
+			if err := f([]byte(key), val); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func (m *Memory) Batch() (hnsw.Batch, error) {
+	return &memoryBatch{store: m, kv: make(map[string][]byte)}, nil
+}
+
+// writes are buffered until commit
+type memoryBatch struct {
+	store *Memory
+	kv    map[string][]byte
+}
+
+func (b *memoryBatch) Put(key, val []byte) error {
+	b.kv[string(key)] = bytes.Clone(val)
+	return nil
+}
+
+func (b *memoryBatch) Commit() error {
+	b.store.mu.Lock()
+	defer b.store.mu.Unlock()
+
+	for key, val := range b.kv {
+		b.store.kv[key] = val
+	}
+	clear(b.kv)
+
+	return nil
+}
+
+func (b *memoryBatch) Rollback() { clear(b.kv) }
@@ -0,0 +1,68 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package store
+
+import (
+	"bytes"
+	"errors"
+
+	"github.com/akrylysov/pogreb"
+	"github.com/fogfish/hnsw"
+)
+
+// Key/value storage backed by embedded pogreb database. Batches are not
+// supported, the index is not written atomically (see package docs).
+type Pogreb struct {
+	db *pogreb.DB
+}
+
+var _ hnsw.Scanner = (*Pogreb)(nil)
+
+// Open pogreb database at the path, it is created if it does not exist.
+// Default options are used if opts is nil.
+func OpenPogreb(path string, opts *pogreb.Options) (*Pogreb, error) {
+	db, err := pogreb.Open(path, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Pogreb{db: db}, nil
+}
+
+// Underlying database
+func (p *Pogreb) DB() *pogreb.DB { return p.db }
+
+func (p *Pogreb) Get(key []byte) ([]byte, error) { return p.db.Get(key) }
+
+func (p *Pogreb) Put(key, val []byte) error { return p.db.Put(key, val) }
+
+func (p *Pogreb) Scan(prefix []byte, f func(key, val []byte) error) error {
+	it := p.db.Items()
+	for {
+		key, val, err := it.Next()
+		if errors.Is(err, pogreb.ErrIterationDone) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if bytes.HasPrefix(key, prefix) {
+			if err := f(key, val); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// Sync database to disk
+func (p *Pogreb) Sync() error { return p.db.Sync() }
+
+// Close database
+func (p *Pogreb) Close() error { return p.db.Close() }
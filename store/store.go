@@ -0,0 +1,33 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+// Package store implements key/value storages for persistence of the index,
+// see hnsw.Reader and hnsw.Writer:
+//
+//	store.NewMemory() // in-memory map, e.g. for tests
+//	store.NewDir(path) // directory, a file per key
+//	store.OpenPogreb(path, nil) // embedded key/value database
+//
+// All storages return nil value for missing keys.
+//
+// Only Memory implements hnsw.BatchWriter. Dir and Pogreb are not atomic:
+// each value is written independently, the failed or interrupted Write and
+// WriteDelta leave the storage with partially written index. Write the index
+// into the new storage (e.g. new directory) and swap it with the old one if
+// atomic update is required, use Verify to detect partially written index.
+package store
+
+import (
+	"github.com/fogfish/hnsw"
+)
+
+// Store is key/value storage for the index
+type Store interface {
+	hnsw.Reader
+	hnsw.Writer
+}
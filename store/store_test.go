@@ -0,0 +1,40 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package store_test
+
+import (
+	"path/filepath"
+	"testing"
+
+	"github.com/fogfish/hnsw/store"
+	"github.com/fogfish/hnsw/store/storetest"
+)
+
+func TestMemory(t *testing.T) {
+	storetest.TestStore(t, store.NewMemory())
+}
+
+func TestDir(t *testing.T) {
+	dir, err := store.NewDir(filepath.Join(t.TempDir(), "index"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	storetest.TestStore(t, dir)
+}
+
+func TestPogreb(t *testing.T) {
+	db, err := store.OpenPogreb(filepath.Join(t.TempDir(), "index"), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	storetest.TestStore(t, db)
+}
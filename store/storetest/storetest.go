@@ -0,0 +1,223 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+// Package storetest implements conformance tests of key/value storages
+// against hnsw.Reader and hnsw.Writer contracts, including optional batches
+// and scans.
+package storetest
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"sort"
+	"testing"
+
+	"github.com/fogfish/hnsw"
+	"github.com/fogfish/hnsw/store"
+	"github.com/fogfish/hnsw/vector"
+	surface "github.com/kshard/vector"
+)
+
+// Store is key/value storage under the test
+type Store = store.Store
+
+// TestStore runs conformance tests for the empty storage.
+func TestStore(t *testing.T, store Store) {
+	t.Helper()
+
+	t.Run("GetMissing", func(t *testing.T) { testGetMissing(t, store) })
+	t.Run("PutGet", func(t *testing.T) { testPutGet(t, store) })
+	t.Run("Overwrite", func(t *testing.T) { testOverwrite(t, store) })
+
+	if s, ok := store.(hnsw.Scanner); ok {
+		t.Run("Scan", func(t *testing.T) { testScan(t, store, s) })
+	}
+
+	if s, ok := store.(hnsw.BatchReader); ok {
+		t.Run("GetBatch", func(t *testing.T) { testGetBatch(t, store, s) })
+	}
+
+	if s, ok := store.(hnsw.BatchWriter); ok {
+		t.Run("Batch", func(t *testing.T) { testBatch(t, store, s) })
+	}
+
+	t.Run("Index", func(t *testing.T) { testIndex(t, store) })
+}
+
+func testGetMissing(t *testing.T, store Store) {
+	val, err := store.Get([]byte("missing"))
+	if err != nil || val != nil {
+		t.Errorf("Unexpected value %v, %v for missing key", val, err)
+	}
+}
+
+func testPutGet(t *testing.T, store Store) {
+	// keys are binary
+	key := []byte{'&', 0x00, 0xff, 0x10, 0x7f}
+	val := []byte("value")
+
+	if err := store.Put(key, val); err != nil {
+		t.Fatalf("Put failed %v", err)
+	}
+
+	// the storage does not retain buffers
+	key[1], val[0] = 0x01, 'X'
+
+	got, err := store.Get([]byte{'&', 0x00, 0xff, 0x10, 0x7f})
+	if err != nil || string(got) != "value" {
+		t.Errorf("Unexpected value %q, %v", got, err)
+	}
+
+	got, err = store.Get(key)
+	if err != nil || got != nil {
+		t.Errorf("Unexpected value %q, %v", got, err)
+	}
+}
+
+func testOverwrite(t *testing.T, store Store) {
+	key := []byte("overwrite")
+
+	for _, val := range []string{"a", "bb", "c"} {
+		if err := store.Put(key, []byte(val)); err != nil {
+			t.Fatalf("Put failed %v", err)
+		}
+	}
+
+	got, err := store.Get(key)
+	if err != nil || string(got) != "c" {
+		t.Errorf("Unexpected value %q, %v", got, err)
+	}
+}
+
+func testScan(t *testing.T, store Store, scanner hnsw.Scanner) {
+	expect := []string{"scan/a", "scan/b", "scan/c"}
+	for _, key := range append([]string{"other", "sca"}, expect...) {
+		if err := store.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Put failed %v", err)
+		}
+	}
+
+	seq := []string{}
+	err := scanner.Scan([]byte("scan/"),
+		func(key, val []byte) error {
+			if !bytes.Equal(key, val) {
+				t.Errorf("Unexpected value %q of key %q", val, key)
+			}
+			seq = append(seq, string(key))
+			return nil
+		},
+	)
+	if err != nil {
+		t.Errorf("Scan failed %v", err)
+	}
+
+	sort.Strings(seq)
+	if len(seq) != len(expect) || seq[0] != expect[0] || seq[1] != expect[1] || seq[2] != expect[2] {
+		t.Errorf("Unexpected keys %q", seq)
+	}
+
+	// error of callback terminates the scan
+	stop := errors.New("stop")
+	if err := scanner.Scan([]byte("scan/"), func(key, val []byte) error { return stop }); !errors.Is(err, stop) {
+		t.Errorf("Unexpected error %v", err)
+	}
+}
+
+func testGetBatch(t *testing.T, store Store, reader hnsw.BatchReader) {
+	for _, key := range []string{"batch/a", "batch/b"} {
+		if err := store.Put([]byte(key), []byte(key)); err != nil {
+			t.Fatalf("Put failed %v", err)
+		}
+	}
+
+	vals, err := reader.GetBatch([][]byte{[]byte("batch/a"), []byte("batch/x"), []byte("batch/b")})
+	if err != nil || len(vals) != 3 {
+		t.Fatalf("GetBatch failed %v", err)
+	}
+
+	if string(vals[0]) != "batch/a" || vals[1] != nil || string(vals[2]) != "batch/b" {
+		t.Errorf("Unexpected values %q", vals)
+	}
+}
+
+func testBatch(t *testing.T, store Store, writer hnsw.BatchWriter) {
+	batch, err := writer.Batch()
+	if err != nil {
+		t.Fatalf("Batch failed %v", err)
+	}
+
+	if err := batch.Put([]byte("tx/rollback"), []byte("value")); err != nil {
+		t.Fatalf("Put failed %v", err)
+	}
+	batch.Rollback()
+
+	if val, err := store.Get([]byte("tx/rollback")); err != nil || val != nil {
+		t.Errorf("Unexpected value %q of rolled back batch, %v", val, err)
+	}
+
+	batch, err = writer.Batch()
+	if err != nil {
+		t.Fatalf("Batch failed %v", err)
+	}
+
+	if err := batch.Put([]byte("tx/commit"), []byte("value")); err != nil {
+		t.Fatalf("Put failed %v", err)
+	}
+
+	// writes are not observable before commit
+	if val, err := store.Get([]byte("tx/commit")); err != nil || val != nil {
+		t.Errorf("Unexpected value %q of uncommitted batch, %v", val, err)
+	}
+
+	if err := batch.Commit(); err != nil {
+		t.Fatalf("Commit failed %v", err)
+	}
+
+	if val, err := store.Get([]byte("tx/commit")); err != nil || string(val) != "value" {
+		t.Errorf("Unexpected value %q of committed batch, %v", val, err)
+	}
+}
+
+func testIndex(t *testing.T, store Store) {
+	rnd := rand.New(rand.NewSource(0x211111111))
+	index := hnsw.New(vector.SurfaceVF32(surface.Euclidean()),
+		hnsw.WithRandomSource(rnd),
+	)
+
+	for i := 0; i < 200; i++ {
+		v := make(surface.F32, 16)
+		for j := range v {
+			v[j] = rnd.Float32()
+		}
+		index.Insert(vector.VF32{Key: uint32(i), Vec: v})
+	}
+
+	if err := index.Write(store); err != nil {
+		t.Fatalf("Write failed %v", err)
+	}
+
+	clone := hnsw.New(vector.SurfaceVF32(surface.Euclidean()))
+	if err := clone.Read(store); err != nil {
+		t.Fatalf("Read failed %v", err)
+	}
+
+	if clone.Size() != index.Size() {
+		t.Errorf("Not equal %s and %s", clone, index)
+	}
+
+	index.ForAll(0,
+		func(rank int, v vector.VF32, vertex []vector.VF32) error {
+			seq := clone.Search(v, 1, 100)
+			if len(seq) == 0 || seq[0].Key != v.Key {
+				t.Errorf("Not found %v in %v", v, seq)
+			}
+			return nil
+		},
+	)
+}
@@ -0,0 +1,433 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"bufio"
+	"encoding"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"math"
+
+	"github.com/kelindar/binary"
+)
+
+// Snapshot file format
+//
+//	magic "HNSW" | version uint32 | header | surface | adjacency | vectors
+//
+// Each section is terminated by CRC32 (Castagnoli) checksum of its content.
+// The header section is length-prefixed binary header with metadata (see
+// Metadata), the header of version 1 has no metadata. The surface section is
+// length-prefixed state of the surface (see encoding.BinaryMarshaler), it is
+// empty for stateless surfaces and absent before version 3. The adjacency section
+// is a sequence of nodes, each node is encoded as deleted flag (byte), number
+// of levels and lists of connections at each level (uint32 count followed by
+// pointers). The vectors section is a sequence of length-prefixed binary
+// encoded vectors. All integers are little endian.
+const (
+	streamMagic   = "HNSW"
+	streamVersion = uint32(3)
+
+	// snapshot with header without metadata
+	streamLegacy = uint32(1)
+
+	// snapshot without surface section
+	streamNoSurface = uint32(2)
+
+	// sanity limit on number of levels per node
+	streamMaxLevels = 64
+
+	// sanity limit on the size of header
+	streamMaxHeader = 1 << 20
+
+	// sanity limit on the size of encoded vector
+	streamMaxVector = 1 << 24
+
+	// sanity limit on the size of surface state
+	streamMaxSurface = 1 << 28
+)
+
+var streamCRC = crc32.MakeTable(crc32.Castagnoli)
+
+// WriteTo writes index as self-describing single file snapshot.
+// It implements io.WriterTo interface.
+func (h *HNSW[Vector]) WriteTo(w io.Writer) (int64, error) {
+	h.rwCore.Lock()
+	defer h.rwCore.Unlock()
+
+	for i := 0; i < heapRWSlots; i++ {
+		h.rwHeap[i].Lock()
+		defer h.rwHeap[i].Unlock()
+	}
+
+	sw := newStreamWriter(w)
+
+	sw.bytes([]byte(streamMagic))
+	sw.uint32(streamVersion)
+
+	if err := h.writeStreamHeader(sw); err != nil {
+		return sw.n, err
+	}
+
+	if err := h.writeStreamSurface(sw); err != nil {
+		return sw.n, err
+	}
+
+	h.writeStreamAdjacency(sw)
+
+	if err := h.writeStreamVectors(sw); err != nil {
+		return sw.n, err
+	}
+
+	if err := sw.flush(); err != nil {
+		return sw.n, errIO.New(err)
+	}
+
+	return sw.n, nil
+}
+
+func (h *HNSW[Vector]) writeStreamHeader(sw *streamWriter) error {
+	b, err := binary.Marshal(h.header())
+	if err != nil {
+		return errCodec.New(err)
+	}
+
+	sw.uint32(uint32(len(b)))
+	sw.bytes(b)
+	sw.checksum()
+
+	return nil
+}
+
+func (h *HNSW[Vector]) writeStreamSurface(sw *streamWriter) error {
+	var b []byte
+	if surface, ok := h.surface.(encoding.BinaryMarshaler); ok {
+		var err error
+		b, err = surface.MarshalBinary()
+		if err != nil {
+			return errCodec.New(err)
+		}
+	}
+
+	sw.uint32(uint32(len(b)))
+	sw.bytes(b)
+	sw.checksum()
+
+	return nil
+}
+
+func (h *HNSW[Vector]) writeStreamAdjacency(sw *streamWriter) {
+	for _, node := range h.heap {
+		if node.Deleted {
+			sw.bytes([]byte{1})
+		} else {
+			sw.bytes([]byte{0})
+		}
+
+		sw.uint32(uint32(len(node.Connections)))
+		for _, edges := range node.Connections {
+			sw.uint32(uint32(len(edges)))
+			for _, e := range edges {
+				sw.uint32(e)
+			}
+		}
+	}
+	sw.checksum()
+}
+
+func (h *HNSW[Vector]) writeStreamVectors(sw *streamWriter) error {
+	for addr := range h.heap {
+		v, ok := h.resolve(Pointer(addr), h.heap[addr].Vector)
+		if !ok {
+			return h.Err()
+		}
+
+		b, err := h.encodeVector(v)
+		if err != nil {
+			return errCodec.New(err)
+		}
+
+		sw.uint32(uint32(len(b)))
+		sw.bytes(b)
+	}
+	sw.checksum()
+
+	return nil
+}
+
+// ReadFrom reads index from self-describing single file snapshot.
+// It implements io.ReaderFrom interface.
+func (h *HNSW[Vector]) ReadFrom(r io.Reader) (int64, error) {
+	h.rwCompact.Lock()
+	defer h.rwCompact.Unlock()
+
+	return h.readFrom(r)
+}
+
+// read snapshot, the caller must hold write lock of compaction
+func (h *HNSW[Vector]) readFrom(r io.Reader) (int64, error) {
+	sr := newStreamReader(r)
+
+	magic := sr.bytes(len(streamMagic))
+	if sr.err == nil && string(magic) != streamMagic {
+		return sr.n, errCodec.New(fmt.Errorf("invalid magic %q", magic))
+	}
+
+	version := sr.uint32()
+	if sr.err == nil && (version < streamLegacy || version > streamVersion) {
+		return sr.n, errCodec.New(fmt.Errorf("unsupported version %d", version))
+	}
+
+	// legacy snapshot contains header without metadata
+	var v header
+	var err error
+	size := sr.uint32()
+	if size > streamMaxHeader {
+		return sr.n, errCodec.New(fmt.Errorf("invalid header size %d", size))
+	}
+
+	b := sr.bytes(int(size))
+	if version == streamLegacy {
+		v, err = decodeLegacyHeader(b)
+	} else {
+		err = binary.Unmarshal(b, &v)
+	}
+	if sr.err == nil && err != nil {
+		return sr.n, errCodec.New(err)
+	}
+	if err := sr.checksum("header"); err != nil {
+		return sr.n, err
+	}
+
+	format := formatVersion
+	if version == streamLegacy {
+		format = 0
+	}
+	if err := h.compatible(v, format); err != nil {
+		return sr.n, err
+	}
+
+	var state []byte
+	if version > streamNoSurface {
+		size := sr.uint32()
+		if size > streamMaxSurface {
+			return sr.n, errCodec.New(fmt.Errorf("invalid surface size %d", size))
+		}
+
+		state = sr.bytes(int(size))
+		if err := sr.checksum("surface"); err != nil {
+			return sr.n, err
+		}
+	}
+
+	if v.Size < 0 || int64(v.Size) > math.MaxUint32 {
+		return sr.n, errCodec.New(fmt.Errorf("invalid size %d", v.Size))
+	}
+
+	heap := make([]Node[Vector], v.Size)
+	for i := range heap {
+		heap[i].Deleted = sr.bytes(1)[0] == 1
+
+		levels := sr.uint32()
+		if levels > streamMaxLevels {
+			return sr.n, errCodec.New(fmt.Errorf("invalid number of levels %d at node %d", levels, i))
+		}
+
+		heap[i].Connections = make([][]Pointer, levels)
+		for lvl := range heap[i].Connections {
+			size := sr.uint32()
+			if size > uint32(v.Size) {
+				return sr.n, errCodec.New(fmt.Errorf("invalid number of edges %d at node %d", size, i))
+			}
+
+			edges := make([]Pointer, size)
+			for e := range edges {
+				edges[e] = sr.uint32()
+				if sr.err == nil && int(edges[e]) >= v.Size {
+					return sr.n, errNodeDangling.New(ErrCorrupted, Pointer(i))
+				}
+			}
+			heap[i].Connections[lvl] = edges
+		}
+
+		if sr.err != nil {
+			return sr.n, errIO.New(sr.err)
+		}
+	}
+	if err := sr.checksum("adjacency"); err != nil {
+		return sr.n, err
+	}
+
+	for i := range heap {
+		size := sr.uint32()
+		if size > streamMaxVector {
+			return sr.n, errCodec.New(fmt.Errorf("invalid vector size %d at node %d", size, i))
+		}
+
+		b := sr.bytes(int(size))
+		if sr.err != nil {
+			return sr.n, errIO.New(sr.err)
+		}
+
+		v, err := h.decodeVector(b)
+		if err != nil {
+			return sr.n, errCodec.New(err)
+		}
+		heap[i].Vector = v
+	}
+	if err := sr.checksum("vectors"); err != nil {
+		return sr.n, err
+	}
+
+	if len(heap) > 0 {
+		if int(v.Head) >= len(heap) {
+			return sr.n, errCodec.New(fmt.Errorf("%w: head %d is beyond the heap", ErrCorrupted, v.Head))
+		}
+
+		if v.Level != len(heap[v.Head].Connections) {
+			return sr.n, errCodec.New(fmt.Errorf("%w: level %d does not match head %d", ErrCorrupted, v.Level, v.Head))
+		}
+
+		if err := checkDimension(v, heap[v.Head].Vector); err != nil {
+			return sr.n, err
+		}
+	}
+
+	h.rwCore.Lock()
+	defer h.rwCore.Unlock()
+
+	for i := 0; i < heapRWSlots; i++ {
+		h.rwHeap[i].Lock()
+		defer h.rwHeap[i].Unlock()
+	}
+
+	if surface, ok := h.surface.(encoding.BinaryUnmarshaler); ok && len(state) > 0 {
+		if err := surface.UnmarshalBinary(state); err != nil {
+			return sr.n, errCodec.New(err)
+		}
+	}
+
+	h.withHeader(v)
+	h.heap = heap
+	h.lazy = nil
+
+	// the snapshot is not related to persistent key/value storage
+	h.rwDirty.Lock()
+	h.dirty.ClearAll()
+	h.dirtyAll = true
+	h.rwDirty.Unlock()
+
+	return sr.n, nil
+}
+
+//------------------------------------------------------------------------------
+
+// streaming writer, accumulating checksum of the section and the first error
+type streamWriter struct {
+	w   *bufio.Writer
+	crc hash.Hash32
+	buf [4]byte
+	n   int64
+	err error
+}
+
+func newStreamWriter(w io.Writer) *streamWriter {
+	return &streamWriter{
+		w:   bufio.NewWriter(w),
+		crc: crc32.New(streamCRC),
+	}
+}
+
+func (sw *streamWriter) bytes(b []byte) {
+	if sw.err != nil {
+		return
+	}
+
+	n, err := sw.w.Write(b)
+	sw.crc.Write(b[:n])
+	sw.n += int64(n)
+	sw.err = err
+}
+
+func (sw *streamWriter) uint32(v uint32) {
+	binary.LittleEndian.PutUint32(sw.buf[:], v)
+	sw.bytes(sw.buf[:])
+}
+
+// terminate the section with checksum
+func (sw *streamWriter) checksum() {
+	sw.uint32(sw.crc.Sum32())
+	sw.crc.Reset()
+}
+
+func (sw *streamWriter) flush() error {
+	if sw.err != nil {
+		return sw.err
+	}
+
+	return sw.w.Flush()
+}
+
+// streaming reader, accumulating checksum of the section and the first error
+type streamReader struct {
+	r   *bufio.Reader
+	crc hash.Hash32
+	n   int64
+	err error
+}
+
+func newStreamReader(r io.Reader) *streamReader {
+	return &streamReader{
+		r:   bufio.NewReader(r),
+		crc: crc32.New(streamCRC),
+	}
+}
+
+func (sr *streamReader) bytes(size int) []byte {
+	b := make([]byte, size)
+	if sr.err != nil {
+		return b
+	}
+
+	n, err := io.ReadFull(sr.r, b)
+	sr.crc.Write(b[:n])
+	sr.n += int64(n)
+	sr.err = err
+
+	return b
+}
+
+func (sr *streamReader) uint32() uint32 {
+	return binary.LittleEndian.Uint32(sr.bytes(4))
+}
+
+// validate checksum of the section
+func (sr *streamReader) checksum(section string) error {
+	expected := sr.crc.Sum32()
+
+	var b [4]byte
+	if sr.err == nil {
+		_, sr.err = io.ReadFull(sr.r, b[:])
+		sr.n += 4
+	}
+
+	if sr.err != nil {
+		return errIO.New(sr.err)
+	}
+
+	if binary.LittleEndian.Uint32(b[:]) != expected {
+		return errCodec.New(fmt.Errorf("checksum mismatch at %s section", section))
+	}
+
+	sr.crc.Reset()
+	return nil
+}
@@ -0,0 +1,120 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"math/bits"
+	"strconv"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/kshard/vector"
+)
+
+// Binary quantized vector, each dimension is encoded by a bit packed into
+// 64-bit words.
+type Bits = []uint64
+
+// Encode float32 vector into bits by sign, the bit is set for positive values
+func Binary(v vector.F32) Bits {
+	b := make(Bits, (len(v)+63)/64)
+	for i, x := range v {
+		if x > 0 {
+			b[i/64] |= 1 << (i % 64)
+		}
+	}
+	return b
+}
+
+// Hamming distance between binary quantized vectors
+func Hamming() vector.Surface[Bits] { return hamming{} }
+
+type hamming struct{}
+
+func (hamming) Equal(a, b Bits) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (hamming) Distance(a, b Bits) float32 {
+	d := 0
+	for i := range a {
+		d += bits.OnesCount64(a[i] ^ b[i])
+	}
+	return float32(d)
+}
+
+//------------------------------------------------------------------------------
+
+// Binary quantized vector annotated with uint32 key
+type VBits struct {
+	Key uint32 `json:"k"`
+	Vec Bits   `json:"v"`
+}
+
+func (v VBits) String() string { return strconv.Itoa(int(v.Key)) }
+
+// Encode vector annotated with uint32 key into bits by sign
+func BinaryVF32(v VF32) VBits {
+	return VBits{Key: v.Key, Vec: Binary(v.Vec)}
+}
+
+// Create surface distance function for type VBits
+// Vectors are equal only if their keys are equal, distinct vectors might
+// share the same sign pattern.
+func SurfaceVBits(surface vector.Surface[Bits]) vector.Surface[VBits] {
+	return keyed[uint32, Bits, VBits]{
+		Surface: surface,
+		key:     func(e VBits) uint32 { return e.Key },
+		vec:     func(e VBits) Bits { return e.Vec },
+	}
+}
+
+// Rerank function for type VBits, see Rerank for details.
+func RerankVBits(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(VBits) (float32, error) {
+	return Rerank(r, surface, q, func(v VBits) []byte { return keyU32(v.Key) })
+}
+
+//------------------------------------------------------------------------------
+
+// Binary quantized vector annotated with K-order number
+type KBits struct {
+	Key guid.K `json:"k"`
+	Vec Bits   `json:"v"`
+}
+
+func (v KBits) String() string { return v.Key.String() }
+
+// Encode vector annotated with K-order number into bits by sign
+func BinaryKF32(v KF32) KBits {
+	return KBits{Key: v.Key, Vec: Binary(v.Vec)}
+}
+
+// Create surface distance function for type KBits
+// Vectors are equal only if their keys are equal, see SurfaceVBits.
+func SurfaceKBits(surface vector.Surface[Bits]) vector.Surface[KBits] {
+	return keyed[guid.K, Bits, KBits]{
+		Surface: surface,
+		key:     func(e KBits) guid.K { return e.Key },
+		vec:     func(e KBits) Bits { return e.Vec },
+	}
+}
+
+// Rerank function for type KBits, see Rerank for details.
+func RerankKBits(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(KBits) (float32, error) {
+	return Rerank(r, surface, q, func(v KBits) []byte { return keyK(v.Key) })
+}
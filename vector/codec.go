@@ -0,0 +1,80 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/kshard/vector"
+)
+
+// Codec of type VF32 (see hnsw.WithCodec), the vector is encoded as
+// little endian key followed by little endian float32 values.
+type CodecVF32 struct{}
+
+func (CodecVF32) Encode(v VF32) ([]byte, error) {
+	b := make([]byte, 4, 4+4*len(v.Vec))
+	binary.LittleEndian.PutUint32(b, v.Key)
+	return appendF32(b, v.Vec), nil
+}
+
+func (CodecVF32) Decode(b []byte) (VF32, error) {
+	if len(b) < 4 || len(b)%4 != 0 {
+		return VF32{}, fmt.Errorf("invalid length %d of VF32", len(b))
+	}
+
+	return VF32{
+		Key: binary.LittleEndian.Uint32(b),
+		Vec: decodeF32(b[4:]),
+	}, nil
+}
+
+// Codec of type KF32 (see hnsw.WithCodec), the vector is encoded as
+// little endian K-order number (hi, lo) followed by little endian float32
+// values.
+type CodecKF32 struct{}
+
+func (CodecKF32) Encode(v KF32) ([]byte, error) {
+	b := make([]byte, 16, 16+4*len(v.Vec))
+	binary.LittleEndian.PutUint64(b, v.Key.Hi)
+	binary.LittleEndian.PutUint64(b[8:], v.Key.Lo)
+	return appendF32(b, v.Vec), nil
+}
+
+func (CodecKF32) Decode(b []byte) (KF32, error) {
+	if len(b) < 16 || len(b)%4 != 0 {
+		return KF32{}, fmt.Errorf("invalid length %d of KF32", len(b))
+	}
+
+	return KF32{
+		Key: guid.K{
+			Hi: binary.LittleEndian.Uint64(b),
+			Lo: binary.LittleEndian.Uint64(b[8:]),
+		},
+		Vec: decodeF32(b[16:]),
+	}, nil
+}
+
+func appendF32(b []byte, v vector.F32) []byte {
+	for _, x := range v {
+		b = binary.LittleEndian.AppendUint32(b, math.Float32bits(x))
+	}
+	return b
+}
+
+func decodeF32(b []byte) vector.F32 {
+	v := make(vector.F32, len(b)/4)
+	for i := range v {
+		v[i] = math.Float32frombits(binary.LittleEndian.Uint32(b[4*i:]))
+	}
+	return v
+}
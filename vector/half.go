@@ -0,0 +1,311 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/kshard/vector"
+)
+
+// Vector of IEEE 754 half precision floats (float16)
+type F16 []uint16
+
+// Convert float32 vector to half precision, rounding to nearest even
+func ToF16(v vector.F32) F16 {
+	h := make(F16, len(v))
+	for i, x := range v {
+		h[i] = f32ToF16(x)
+	}
+	return h
+}
+
+// Convert half precision vector to float32
+func (v F16) F32() vector.F32 {
+	f := make(vector.F32, len(v))
+	for i, x := range v {
+		f[i] = f16ToF32(x)
+	}
+	return f
+}
+
+func f32ToF16(x float32) uint16 {
+	b := math.Float32bits(x)
+	sign := uint16(b>>16) & 0x8000
+	exp := int(b>>23) & 0xff
+	mant := b & 0x7fffff
+
+	if exp == 0xff {
+		if mant != 0 {
+			return sign | 0x7e00
+		}
+		return sign | 0x7c00
+	}
+
+	e := exp - 127 + 15
+	switch {
+	case e >= 0x1f:
+		return sign | 0x7c00
+	case e <= 0:
+		if e < -10 {
+			return sign
+		}
+
+		// subnormal
+		mant |= 0x800000
+		shift := uint(14 - e)
+		h := mant >> shift
+		rem, half := mant&(1<<shift-1), uint32(1)<<(shift-1)
+		if rem > half || (rem == half && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	default:
+		h := uint32(e)<<10 | mant>>13
+		rem := mant & 0x1fff
+		if rem > 0x1000 || (rem == 0x1000 && h&1 == 1) {
+			h++
+		}
+		return sign | uint16(h)
+	}
+}
+
+// float16 to float32 conversion table
+var f16Table [1 << 16]float32
+
+func init() {
+	for h := range f16Table {
+		f16Table[h] = decodeF16(uint16(h))
+	}
+}
+
+func f16ToF32(h uint16) float32 { return f16Table[h] }
+
+func decodeF16(h uint16) float32 {
+	sign := uint32(h&0x8000) << 16
+	exp := uint32(h>>10) & 0x1f
+	mant := uint32(h & 0x3ff)
+
+	switch exp {
+	case 0:
+		if mant == 0 {
+			return math.Float32frombits(sign)
+		}
+
+		// subnormal
+		e := uint32(127 - 14)
+		for mant&0x400 == 0 {
+			mant <<= 1
+			e--
+		}
+		return math.Float32frombits(sign | e<<23 | (mant&0x3ff)<<13)
+	case 0x1f:
+		return math.Float32frombits(sign | 0x7f800000 | mant<<13)
+	default:
+		return math.Float32frombits(sign | (exp-15+127)<<23 | mant<<13)
+	}
+}
+
+// Vector of brain floating point numbers (bfloat16)
+type BF16 []uint16
+
+// Convert float32 vector to bfloat16, rounding to nearest even
+func ToBF16(v vector.F32) BF16 {
+	h := make(BF16, len(v))
+	for i, x := range v {
+		h[i] = f32ToBF16(x)
+	}
+	return h
+}
+
+// Convert bfloat16 vector to float32
+func (v BF16) F32() vector.F32 {
+	f := make(vector.F32, len(v))
+	for i, x := range v {
+		f[i] = bf16ToF32(x)
+	}
+	return f
+}
+
+func f32ToBF16(x float32) uint16 {
+	b := math.Float32bits(x)
+	if x != x {
+		return uint16(b>>16) | 0x40
+	}
+
+	return uint16((b + 0x7fff + (b>>16)&1) >> 16)
+}
+
+func bf16ToF32(h uint16) float32 { return math.Float32frombits(uint32(h) << 16) }
+
+//------------------------------------------------------------------------------
+
+// Euclidean distance (squared) between half precision vectors
+func EuclideanF16() vector.Surface[F16] { return euclidean16[F16]{f16ToF32} }
+
+// Cosine distance between half precision vectors, (1 - cos(a, b)) / 2
+func CosineF16() vector.Surface[F16] { return cosine16[F16]{f16ToF32} }
+
+// Inner product distance between half precision vectors, 1 - a·b
+func InnerProductF16() vector.Surface[F16] { return innerProduct16[F16]{f16ToF32} }
+
+// Euclidean distance (squared) between bfloat16 vectors
+func EuclideanBF16() vector.Surface[BF16] { return euclidean16[BF16]{bf16ToF32} }
+
+// Cosine distance between bfloat16 vectors, (1 - cos(a, b)) / 2
+func CosineBF16() vector.Surface[BF16] { return cosine16[BF16]{bf16ToF32} }
+
+// Inner product distance between bfloat16 vectors, 1 - a·b
+func InnerProductBF16() vector.Surface[BF16] { return innerProduct16[BF16]{bf16ToF32} }
+
+type euclidean16[T ~[]uint16] struct{ f32 func(uint16) float32 }
+
+func (euclidean16[T]) Equal(a, b T) bool { return equal16(a, b) }
+
+func (s euclidean16[T]) Distance(a, b T) (d float32) {
+	for i := range a {
+		x := s.f32(a[i]) - s.f32(b[i])
+		d += x * x
+	}
+	return
+}
+
+type cosine16[T ~[]uint16] struct{ f32 func(uint16) float32 }
+
+func (cosine16[T]) Equal(a, b T) bool { return equal16(a, b) }
+
+func (s cosine16[T]) Distance(a, b T) float32 {
+	ab, aa, bb := float32(0), float32(0), float32(0)
+	for i := range a {
+		x, y := s.f32(a[i]), s.f32(b[i])
+		ab += x * y
+		aa += x * x
+		bb += y * y
+	}
+
+	return (1 - ab/float32(math.Sqrt(float64(aa))*math.Sqrt(float64(bb)))) / 2
+}
+
+type innerProduct16[T ~[]uint16] struct{ f32 func(uint16) float32 }
+
+func (innerProduct16[T]) Equal(a, b T) bool { return equal16(a, b) }
+
+func (s innerProduct16[T]) Distance(a, b T) float32 {
+	ab := float32(0)
+	for i := range a {
+		ab += s.f32(a[i]) * s.f32(b[i])
+	}
+
+	return 1 - ab
+}
+
+func equal16[T ~[]uint16](a, b T) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//------------------------------------------------------------------------------
+
+// Vector of float16 annotated with uint32 key
+type VF16 struct {
+	Key uint32 `json:"k"`
+	Vec F16    `json:"v"`
+}
+
+func (v VF16) String() string { return strconv.Itoa(int(v.Key)) }
+
+// Convert vector annotated with uint32 key to half precision
+func ToVF16(v VF32) VF16 { return VF16{Key: v.Key, Vec: ToF16(v.Vec)} }
+
+// Create surface distance function for type VF16
+// Vectors are equal only if their keys are equal, distinct vectors might
+// share the same value after conversion.
+func SurfaceVF16(surface vector.Surface[F16]) vector.Surface[VF16] {
+	return keyed[uint32, F16, VF16]{
+		Surface: surface,
+		key:     func(e VF16) uint32 { return e.Key },
+		vec:     func(e VF16) F16 { return e.Vec },
+	}
+}
+
+// Vector of float16 annotated with K-order number
+type KF16 struct {
+	Key guid.K `json:"k"`
+	Vec F16    `json:"v"`
+}
+
+func (v KF16) String() string { return v.Key.String() }
+
+// Convert vector annotated with K-order number to half precision
+func ToKF16(v KF32) KF16 { return KF16{Key: v.Key, Vec: ToF16(v.Vec)} }
+
+// Create surface distance function for type KF16
+// Vectors are equal only if their keys are equal, see SurfaceVF16.
+func SurfaceKF16(surface vector.Surface[F16]) vector.Surface[KF16] {
+	return keyed[guid.K, F16, KF16]{
+		Surface: surface,
+		key:     func(e KF16) guid.K { return e.Key },
+		vec:     func(e KF16) F16 { return e.Vec },
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// Vector of bfloat16 annotated with uint32 key
+type VBF16 struct {
+	Key uint32 `json:"k"`
+	Vec BF16   `json:"v"`
+}
+
+func (v VBF16) String() string { return strconv.Itoa(int(v.Key)) }
+
+// Convert vector annotated with uint32 key to bfloat16
+func ToVBF16(v VF32) VBF16 { return VBF16{Key: v.Key, Vec: ToBF16(v.Vec)} }
+
+// Create surface distance function for type VBF16
+// Vectors are equal only if their keys are equal, see SurfaceVF16.
+func SurfaceVBF16(surface vector.Surface[BF16]) vector.Surface[VBF16] {
+	return keyed[uint32, BF16, VBF16]{
+		Surface: surface,
+		key:     func(e VBF16) uint32 { return e.Key },
+		vec:     func(e VBF16) BF16 { return e.Vec },
+	}
+}
+
+// Vector of bfloat16 annotated with K-order number
+type KBF16 struct {
+	Key guid.K `json:"k"`
+	Vec BF16   `json:"v"`
+}
+
+func (v KBF16) String() string { return v.Key.String() }
+
+// Convert vector annotated with K-order number to bfloat16
+func ToKBF16(v KF32) KBF16 { return KBF16{Key: v.Key, Vec: ToBF16(v.Vec)} }
+
+// Create surface distance function for type KBF16
+// Vectors are equal only if their keys are equal, see SurfaceVF16.
+func SurfaceKBF16(surface vector.Surface[BF16]) vector.Surface[KBF16] {
+	return keyed[guid.K, BF16, KBF16]{
+		Surface: surface,
+		key:     func(e KBF16) guid.K { return e.Key },
+		vec:     func(e KBF16) BF16 { return e.Vec },
+	}
+}
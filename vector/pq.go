@@ -0,0 +1,369 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"fmt"
+	"math"
+	"math/rand"
+	"strconv"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/fogfish/hnsw"
+	"github.com/kelindar/binary"
+	"github.com/kshard/vector"
+)
+
+// Product quantized vector, each sub-space is encoded by the index of
+// the nearest centroid.
+type PQ = []uint8
+
+// Number of k-means iterations used for training of codebooks
+const pqIterations = 25
+
+// Product quantizer of float32 vectors. The vector space is split into
+// M sub-spaces, each sub-space is encoded by one of K centroids of
+// the codebook trained by k-means on the sample of vectors.
+//
+// Distances are squared euclidean. The distance from the query to encoded
+// vector is computed asymmetrically using lookup table built per query
+// (see QueryVPQ), distance between encoded vectors is computed symmetrically
+// using distances between centroids. Normalize vectors to use cosine
+// distance.
+type ProductQuantizer struct {
+	M         int         `json:"m"`
+	K         int         `json:"k"`
+	Dim       int         `json:"dim"`
+	Codebooks [][]float32 `json:"codebooks"`
+
+	// distances between centroids, K × K per sub-space
+	sdc [][]float32
+}
+
+// Train product quantizer with m sub-spaces and k centroids per sub-space on
+// the sample of vectors. Dimension of vectors must be multiple of m, number
+// of centroids is limited by 256.
+func NewProductQuantizer(sample []vector.F32, m, k int, random rand.Source) (*ProductQuantizer, error) {
+	if len(sample) < k {
+		return nil, fmt.Errorf("sample of %d vectors is less than %d centroids", len(sample), k)
+	}
+
+	if k < 1 || k > 256 {
+		return nil, fmt.Errorf("invalid number of centroids %d", k)
+	}
+
+	dim := len(sample[0])
+	if m < 1 || dim%m != 0 {
+		return nil, fmt.Errorf("dimension %d is not multiple of %d sub-spaces", dim, m)
+	}
+
+	pq := &ProductQuantizer{
+		M:         m,
+		K:         k,
+		Dim:       dim,
+		Codebooks: make([][]float32, m),
+	}
+
+	rnd := rand.New(random)
+	sub := dim / m
+	for s := 0; s < m; s++ {
+		points := make([][]float32, len(sample))
+		for i, v := range sample {
+			points[i] = v[s*sub : (s+1)*sub]
+		}
+		pq.Codebooks[s] = kmeans(points, k, rnd)
+	}
+
+	pq.tables()
+
+	return pq, nil
+}
+
+// k-means clustering, it returns centroids as flat sequence
+func kmeans(points [][]float32, k int, rnd *rand.Rand) []float32 {
+	sub := len(points[0])
+	centroids := make([]float32, k*sub)
+	for c, i := range rnd.Perm(len(points))[:k] {
+		copy(centroids[c*sub:], points[i])
+	}
+
+	assign := make([]int, len(points))
+	counts := make([]int, k)
+	for iter := 0; iter < pqIterations; iter++ {
+		changed := false
+		for i, p := range points {
+			c := nearest(centroids, sub, p)
+			if c != assign[i] || iter == 0 {
+				changed = true
+			}
+			assign[i] = c
+		}
+
+		if !changed {
+			break
+		}
+
+		clear(centroids)
+		clear(counts)
+		for i, p := range points {
+			c := assign[i]
+			counts[c]++
+			for j, x := range p {
+				centroids[c*sub+j] += x
+			}
+		}
+
+		for c := 0; c < k; c++ {
+			if counts[c] == 0 {
+				// re-seed empty cluster with random point
+				copy(centroids[c*sub:], points[rnd.Intn(len(points))])
+				continue
+			}
+
+			for j := 0; j < sub; j++ {
+				centroids[c*sub+j] /= float32(counts[c])
+			}
+		}
+	}
+
+	return centroids
+}
+
+// index of the nearest centroid
+func nearest(centroids []float32, sub int, p []float32) int {
+	c, dist := 0, float32(math.MaxFloat32)
+	for i := 0; i < len(centroids)/sub; i++ {
+		if d := euclidean(centroids[i*sub:(i+1)*sub], p); d < dist {
+			c, dist = i, d
+		}
+	}
+	return c
+}
+
+func euclidean(a, b []float32) (d float32) {
+	for i := range a {
+		x := a[i] - b[i]
+		d += x * x
+	}
+	return
+}
+
+// build symmetric distance tables
+func (pq *ProductQuantizer) tables() {
+	sub := pq.Dim / pq.M
+	pq.sdc = make([][]float32, pq.M)
+	for s, codebook := range pq.Codebooks {
+		table := make([]float32, pq.K*pq.K)
+		for i := 0; i < pq.K; i++ {
+			for j := 0; j < pq.K; j++ {
+				table[i*pq.K+j] = euclidean(codebook[i*sub:(i+1)*sub], codebook[j*sub:(j+1)*sub])
+			}
+		}
+		pq.sdc[s] = table
+	}
+}
+
+// Encode float32 vector
+func (pq *ProductQuantizer) Encode(v vector.F32) PQ {
+	sub := pq.Dim / pq.M
+	code := make(PQ, pq.M)
+	for s := range code {
+		code[s] = uint8(nearest(pq.Codebooks[s], sub, v[s*sub:(s+1)*sub]))
+	}
+	return code
+}
+
+// Decode float32 vector, it is approximation of the encoded one
+func (pq *ProductQuantizer) Decode(code PQ) vector.F32 {
+	sub := pq.Dim / pq.M
+	v := make(vector.F32, 0, pq.Dim)
+	for s, c := range code {
+		v = append(v, pq.Codebooks[s][int(c)*sub:(int(c)+1)*sub]...)
+	}
+	return v
+}
+
+// lookup table of distances from the query to centroids, M × K
+func (pq *ProductQuantizer) lookup(q vector.F32) []float32 {
+	sub := pq.Dim / pq.M
+	lut := make([]float32, pq.M*pq.K)
+	for s, codebook := range pq.Codebooks {
+		for c := 0; c < pq.K; c++ {
+			lut[s*pq.K+c] = euclidean(codebook[c*sub:(c+1)*sub], q[s*sub:(s+1)*sub])
+		}
+	}
+	return lut
+}
+
+// distance between codes, lookup table is used if any of vectors is query
+func (pq *ProductQuantizer) distance(a PQ, alut []float32, b PQ, blut []float32) (d float32) {
+	switch {
+	case alut != nil:
+		for s, c := range b {
+			d += alut[s*pq.K+int(c)]
+		}
+	case blut != nil:
+		for s, c := range a {
+			d += blut[s*pq.K+int(c)]
+		}
+	default:
+		for s := range a {
+			d += pq.sdc[s][int(a[s])*pq.K+int(b[s])]
+		}
+	}
+	return
+}
+
+// Encode vector annotated with uint32 key
+func (pq *ProductQuantizer) EncodeVF32(v VF32) VPQ {
+	return VPQ{Key: v.Key, Vec: pq.Encode(v.Vec)}
+}
+
+// Encode vector annotated with K-order number
+func (pq *ProductQuantizer) EncodeKF32(v KF32) KPQ {
+	return KPQ{Key: v.Key, Vec: pq.Encode(v.Vec)}
+}
+
+// Encode query for type VPQ, the query carries lookup table for asymmetric
+// distance computation. The query shall not be inserted into the index.
+func (pq *ProductQuantizer) QueryVPQ(q vector.F32) VPQ {
+	return VPQ{Vec: pq.Encode(q), LUT: pq.lookup(q)}
+}
+
+// Encode query for type KPQ, see QueryVPQ for details.
+func (pq *ProductQuantizer) QueryKPQ(q vector.F32) KPQ {
+	return KPQ{Vec: pq.Encode(q), LUT: pq.lookup(q)}
+}
+
+// codebooks are serialized without distance tables
+type codebooks struct {
+	M, K, Dim int
+	Codebooks [][]float32
+}
+
+// MarshalBinary implements encoding.BinaryMarshaler
+func (pq *ProductQuantizer) MarshalBinary() ([]byte, error) {
+	return binary.Marshal(codebooks{M: pq.M, K: pq.K, Dim: pq.Dim, Codebooks: pq.Codebooks})
+}
+
+// UnmarshalBinary implements encoding.BinaryUnmarshaler
+func (pq *ProductQuantizer) UnmarshalBinary(b []byte) error {
+	var c codebooks
+	if err := binary.Unmarshal(b, &c); err != nil {
+		return err
+	}
+
+	if err := c.validate(); err != nil {
+		return err
+	}
+
+	pq.M, pq.K, pq.Dim, pq.Codebooks = c.M, c.K, c.Dim, c.Codebooks
+	pq.tables()
+	return nil
+}
+
+// codebooks shall match the geometry of quantizer
+func (c codebooks) validate() error {
+	switch {
+	case c.M <= 0:
+		return fmt.Errorf("%w: invalid number of sub-spaces %d", hnsw.ErrCorrupted, c.M)
+	case c.Dim <= 0 || c.Dim%c.M != 0:
+		return fmt.Errorf("%w: dimension %d is not multiple of %d sub-spaces", hnsw.ErrCorrupted, c.Dim, c.M)
+	case c.K < 1 || c.K > 256:
+		return fmt.Errorf("%w: invalid number of centroids %d", hnsw.ErrCorrupted, c.K)
+	case len(c.Codebooks) != c.M:
+		return fmt.Errorf("%w: %d codebooks, expected %d", hnsw.ErrCorrupted, len(c.Codebooks), c.M)
+	}
+
+	for s, codebook := range c.Codebooks {
+		if len(codebook) != c.K*(c.Dim/c.M) {
+			return fmt.Errorf("%w: codebook %d of length %d, expected %d", hnsw.ErrCorrupted, s, len(codebook), c.K*(c.Dim/c.M))
+		}
+	}
+
+	return nil
+}
+
+func equalPQ(a, b PQ) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//------------------------------------------------------------------------------
+
+// Product quantized vector annotated with uint32 key
+type VPQ struct {
+	Key uint32 `json:"k"`
+	Vec PQ     `json:"v"`
+
+	// lookup table of the query, it is nil for encoded vectors
+	LUT []float32 `json:"-"`
+}
+
+func (v VPQ) String() string { return strconv.Itoa(int(v.Key)) }
+
+// Create surface distance function for type VPQ. The surface is persisted
+// together with the index, the quantizer is restored by Read. Vectors are
+// equal only if their keys are equal, distinct vectors might share the code.
+func SurfaceVPQ(pq *ProductQuantizer) vector.Surface[VPQ] {
+	return surfaceVPQ{pq}
+}
+
+type surfaceVPQ struct{ *ProductQuantizer }
+
+func (surfaceVPQ) Equal(a, b VPQ) bool { return a.Key == b.Key && equalPQ(a.Vec, b.Vec) }
+
+func (pq surfaceVPQ) Distance(a, b VPQ) float32 {
+	return pq.distance(a.Vec, a.LUT, b.Vec, b.LUT)
+}
+
+// Rerank function for type VPQ, see Rerank for details.
+func RerankVPQ(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(VPQ) (float32, error) {
+	return Rerank(r, surface, q, func(v VPQ) []byte { return keyU32(v.Key) })
+}
+
+//------------------------------------------------------------------------------
+
+// Product quantized vector annotated with K-order number
+type KPQ struct {
+	Key guid.K `json:"k"`
+	Vec PQ     `json:"v"`
+
+	// lookup table of the query, it is nil for encoded vectors
+	LUT []float32 `json:"-"`
+}
+
+func (v KPQ) String() string { return v.Key.String() }
+
+// Create surface distance function for type KPQ, see SurfaceVPQ for details.
+func SurfaceKPQ(pq *ProductQuantizer) vector.Surface[KPQ] {
+	return surfaceKPQ{pq}
+}
+
+type surfaceKPQ struct{ *ProductQuantizer }
+
+func (surfaceKPQ) Equal(a, b KPQ) bool { return a.Key == b.Key && equalPQ(a.Vec, b.Vec) }
+
+func (pq surfaceKPQ) Distance(a, b KPQ) float32 {
+	return pq.distance(a.Vec, a.LUT, b.Vec, b.LUT)
+}
+
+// Rerank function for type KPQ, see Rerank for details.
+func RerankKPQ(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(KPQ) (float32, error) {
+	return Rerank(r, surface, q, func(v KPQ) []byte { return keyK(v.Key) })
+}
@@ -0,0 +1,78 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"fmt"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/kelindar/binary"
+	"github.com/kshard/vector"
+)
+
+// Reader interface abstracts persistent key/value storage
+type Reader interface{ Get([]byte) ([]byte, error) }
+
+// Writer interface abstract persistent key/value storage
+type Writer interface{ Put([]byte, []byte) error }
+
+// Put original float32 vector into the storage, it is used for reranking of
+// compressed vectors. The vector is stored under '#' followed by its key.
+func PutVF32(w Writer, v VF32) error {
+	return putF32(w, keyU32(v.Key), v.Vec)
+}
+
+// Put original float32 vector into the storage, see PutVF32 for details.
+func PutKF32(w Writer, v KF32) error {
+	return putF32(w, keyK(v.Key), v.Vec)
+}
+
+// Rerank function computes precise distance between original float32 query
+// and compressed vector, the original vector is fetched from the storage
+// by the key (see PutVF32). It is used with hnsw.SearchRerank.
+func Rerank[Vector any](r Reader, surface vector.Surface[vector.F32], q vector.F32, key func(Vector) []byte) func(Vector) (float32, error) {
+	return func(v Vector) (float32, error) {
+		k := key(v)
+
+		b, err := r.Get(k)
+		if err != nil {
+			return 0, err
+		}
+
+		if len(b) == 0 {
+			return 0, fmt.Errorf("original vector %x is not found", k[1:])
+		}
+
+		var vec vector.F32
+		if err := binary.Unmarshal(b, &vec); err != nil {
+			return 0, err
+		}
+
+		return surface.Distance(q, vec), nil
+	}
+}
+
+func putF32(w Writer, key []byte, v vector.F32) error {
+	b, err := binary.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	return w.Put(key, b)
+}
+
+func keyU32(key uint32) []byte {
+	b := [5]byte{'#'}
+	binary.LittleEndian.PutUint32(b[1:], key)
+	return b[:]
+}
+
+func keyK(key guid.K) []byte {
+	return append([]byte{'#'}, guid.Bytes(key)...)
+}
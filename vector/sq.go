@@ -0,0 +1,214 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package vector
+
+import (
+	"math"
+	"strconv"
+
+	"github.com/fogfish/guid/v2"
+	"github.com/kshard/vector"
+)
+
+// Scalar quantized vector, each dimension is encoded by int8
+type I8 = []int8
+
+// Scalar quantizer of float32 vectors into int8. Each dimension is linearly
+// mapped from the range [min, max] observed in the training sample onto 256
+// levels, values outside of the range are clamped.
+type ScalarQuantizer struct {
+	Min   []float32 `json:"min"`
+	Scale []float32 `json:"scale"`
+}
+
+// Train scalar quantizer on the sample of vectors
+func NewScalarQuantizer(sample []vector.F32) *ScalarQuantizer {
+	if len(sample) == 0 {
+		return &ScalarQuantizer{}
+	}
+
+	dim := len(sample[0])
+	lo := make([]float32, dim)
+	hi := make([]float32, dim)
+	copy(lo, sample[0])
+	copy(hi, sample[0])
+
+	for _, v := range sample[1:] {
+		for i, x := range v {
+			lo[i] = min(lo[i], x)
+			hi[i] = max(hi[i], x)
+		}
+	}
+
+	scale := make([]float32, dim)
+	for i := range scale {
+		scale[i] = (hi[i] - lo[i]) / 255
+	}
+
+	return &ScalarQuantizer{Min: lo, Scale: scale}
+}
+
+// Encode float32 vector
+func (sq *ScalarQuantizer) Encode(v vector.F32) I8 {
+	q := make(I8, len(v))
+	for i, x := range v {
+		if sq.Scale[i] == 0 {
+			q[i] = math.MinInt8
+			continue
+		}
+
+		l := math.Round(float64((x - sq.Min[i]) / sq.Scale[i]))
+		q[i] = int8(min(max(l, 0), 255) + math.MinInt8)
+	}
+	return q
+}
+
+// Decode float32 vector, it is approximation of the encoded one
+func (sq *ScalarQuantizer) Decode(q I8) vector.F32 {
+	v := make(vector.F32, len(q))
+	for i := range q {
+		v[i] = sq.value(i, q[i])
+	}
+	return v
+}
+
+func (sq *ScalarQuantizer) value(i int, q int8) float32 {
+	return sq.Min[i] + sq.Scale[i]*float32(int(q)-math.MinInt8)
+}
+
+// Encode vector annotated with uint32 key
+func (sq *ScalarQuantizer) EncodeVF32(v VF32) VI8 {
+	return VI8{Key: v.Key, Vec: sq.Encode(v.Vec)}
+}
+
+// Encode vector annotated with K-order number
+func (sq *ScalarQuantizer) EncodeKF32(v KF32) KI8 {
+	return KI8{Key: v.Key, Vec: sq.Encode(v.Vec)}
+}
+
+// Euclidean distance (squared) between quantized vectors
+func (sq *ScalarQuantizer) Euclidean() vector.Surface[I8] {
+	return sqEuclidean{sq}
+}
+
+// Cosine distance between quantized vectors, (1 - cos(a, b)) / 2
+func (sq *ScalarQuantizer) Cosine() vector.Surface[I8] {
+	return sqCosine{sq}
+}
+
+// Inner product distance between quantized vectors, 1 - a·b
+func (sq *ScalarQuantizer) InnerProduct() vector.Surface[I8] {
+	return sqInnerProduct{sq}
+}
+
+type sqEuclidean struct{ *ScalarQuantizer }
+
+func (sqEuclidean) Equal(a, b I8) bool { return equalI8(a, b) }
+
+func (sq sqEuclidean) Distance(a, b I8) (d float32) {
+	for i := range a {
+		x := sq.Scale[i] * float32(int(a[i])-int(b[i]))
+		d += x * x
+	}
+	return
+}
+
+type sqCosine struct{ *ScalarQuantizer }
+
+func (sqCosine) Equal(a, b I8) bool { return equalI8(a, b) }
+
+func (sq sqCosine) Distance(a, b I8) float32 {
+	ab, aa, bb := float32(0), float32(0), float32(0)
+	for i := range a {
+		x, y := sq.value(i, a[i]), sq.value(i, b[i])
+		ab += x * y
+		aa += x * x
+		bb += y * y
+	}
+
+	return (1 - ab/float32(math.Sqrt(float64(aa))*math.Sqrt(float64(bb)))) / 2
+}
+
+type sqInnerProduct struct{ *ScalarQuantizer }
+
+func (sqInnerProduct) Equal(a, b I8) bool { return equalI8(a, b) }
+
+func (sq sqInnerProduct) Distance(a, b I8) float32 {
+	ab := float32(0)
+	for i := range a {
+		ab += sq.value(i, a[i]) * sq.value(i, b[i])
+	}
+
+	return 1 - ab
+}
+
+func equalI8(a, b I8) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+
+	return true
+}
+
+//------------------------------------------------------------------------------
+
+// Scalar quantized vector annotated with uint32 key
+type VI8 struct {
+	Key uint32 `json:"k"`
+	Vec I8     `json:"v"`
+}
+
+func (v VI8) String() string { return strconv.Itoa(int(v.Key)) }
+
+// Create surface distance function for type VI8
+// Vectors are equal only if their keys are equal, distinct vectors might
+// share the same quantized value.
+func SurfaceVI8(surface vector.Surface[I8]) vector.Surface[VI8] {
+	return keyed[uint32, I8, VI8]{
+		Surface: surface,
+		key:     func(e VI8) uint32 { return e.Key },
+		vec:     func(e VI8) I8 { return e.Vec },
+	}
+}
+
+// Rerank function for type VI8, see Rerank for details.
+func RerankVI8(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(VI8) (float32, error) {
+	return Rerank(r, surface, q, func(v VI8) []byte { return keyU32(v.Key) })
+}
+
+//------------------------------------------------------------------------------
+
+// Scalar quantized vector annotated with K-order number
+type KI8 struct {
+	Key guid.K `json:"k"`
+	Vec I8     `json:"v"`
+}
+
+func (v KI8) String() string { return v.Key.String() }
+
+// Create surface distance function for type KI8
+// Vectors are equal only if their keys are equal, see SurfaceVI8.
+func SurfaceKI8(surface vector.Surface[I8]) vector.Surface[KI8] {
+	return keyed[guid.K, I8, KI8]{
+		Surface: surface,
+		key:     func(e KI8) guid.K { return e.Key },
+		vec:     func(e KI8) I8 { return e.Vec },
+	}
+}
+
+// Rerank function for type KI8, see Rerank for details.
+func RerankKI8(r Reader, surface vector.Surface[vector.F32], q vector.F32) func(KI8) (float32, error) {
+	return Rerank(r, surface, q, func(v KI8) []byte { return keyK(v.Key) })
+}
@@ -48,3 +48,23 @@ func SurfaceKF32(surface vector.Surface[vector.F32]) vector.Surface[KF32] {
 		ContraMap: func(e KF32) vector.F32 { return e.Vec },
 	}
 }
+
+//------------------------------------------------------------------------------
+
+// surface of compressed vectors annotated with key. Compression is lossy,
+// distinct vectors might share the same compressed value, therefore vectors
+// are equal only if both keys and values are equal. Otherwise, the index
+// treats the new vector as the update of existing one.
+type keyed[K comparable, A, B any] struct {
+	Surface vector.Surface[A]
+	key     func(B) K
+	vec     func(B) A
+}
+
+func (s keyed[K, A, B]) Equal(a, b B) bool {
+	return s.key(a) == s.key(b) && s.Surface.Equal(s.vec(a), s.vec(b))
+}
+
+func (s keyed[K, A, B]) Distance(a, b B) float32 {
+	return s.Surface.Distance(s.vec(a), s.vec(b))
+}
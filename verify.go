@@ -0,0 +1,165 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"errors"
+	"fmt"
+	"hash/crc32"
+
+	"github.com/bits-and-blooms/bitset"
+	"github.com/fogfish/faults"
+	"github.com/kelindar/binary"
+)
+
+// ErrCorrupted is the cause of errors reported by Read when the persisted
+// index is corrupted (e.g. truncated storage), use errors.Is to check it.
+var ErrCorrupted = errors.New("corrupted index")
+
+const (
+	errNodeMissing   = faults.Safe1[Pointer]("node %d is missing")
+	errNodeCorrupted = faults.Safe1[Pointer]("node %d is corrupted")
+	errNodeDangling  = faults.Safe1[Pointer]("node %d has dangling pointer")
+)
+
+// Report of the persisted index verification
+type Report struct {
+	// Number of nodes in the index
+	Size int
+
+	// Nodes absent in the storage
+	Missing []Pointer
+
+	// Nodes with invalid checksum or encoding
+	Corrupted []Pointer
+
+	// Nodes connected to nodes beyond the heap
+	Dangling []Pointer
+}
+
+// True if no problems are found
+func (r Report) OK() bool {
+	return len(r.Missing) == 0 && len(r.Corrupted) == 0 && len(r.Dangling) == 0
+}
+
+func (r Report) String() string {
+	return fmt.Sprintf("{ %d | Missing: %d  Corrupted: %d  Dangling: %d}",
+		r.Size, len(r.Missing), len(r.Corrupted), len(r.Dangling))
+}
+
+// Verify the persisted index, checking nodes one by one without loading
+// the index. The error is returned only if the header is unreadable or
+// incompatible, see Read. Checksums are verified for the storage written
+// since version 2 of the format.
+func (h *HNSW[Vector]) Verify(r Reader) (Report, error) {
+	v, version, err := readHeader(r)
+	if err != nil {
+		return Report{}, err
+	}
+
+	if err := h.compatible(v, version); err != nil {
+		return Report{}, err
+	}
+
+	report := Report{Size: v.Size}
+	if v.Size > 0 && int(v.Head) >= v.Size {
+		return report, errCodec.New(fmt.Errorf("%w: head %d is beyond the heap", ErrCorrupted, v.Head))
+	}
+
+	var seen bitset.BitSet
+	err = forNodes(r, v.Size,
+		func(addr Pointer, b []byte) error {
+			seen.Set(uint(addr))
+
+			node, err := h.unsealNode(addr, b, version)
+			switch {
+			case errors.Is(err, errMissing):
+				report.Missing = append(report.Missing, addr)
+			case err != nil:
+				report.Corrupted = append(report.Corrupted, addr)
+			case dangling(node, v.Size):
+				report.Dangling = append(report.Dangling, addr)
+			}
+
+			return nil
+		},
+	)
+	if err != nil {
+		return report, err
+	}
+
+	for addr, ok := seen.NextClear(0); ok && addr < uint(v.Size); addr, ok = seen.NextClear(addr + 1) {
+		report.Missing = append(report.Missing, Pointer(addr))
+	}
+
+	return report, nil
+}
+
+// cause of missing node
+var errMissing = fmt.Errorf("%w: node is missing", ErrCorrupted)
+
+// seal encoded node with checksum
+func seal(b []byte) []byte {
+	return binary.LittleEndian.AppendUint32(b, crc32.Checksum(b, streamCRC))
+}
+
+// decode node of the format version, verifying its checksum if it is sealed
+func (h *HNSW[Vector]) unsealNode(addr Pointer, b []byte, version int) (Node[Vector], error) {
+	var node Node[Vector]
+
+	if len(b) == 0 {
+		return node, errNodeMissing.New(errMissing, addr)
+	}
+
+	// nodes are sealed by checksum since version 2
+	if version >= 2 {
+		if len(b) < 4 {
+			return node, errNodeCorrupted.New(ErrCorrupted, addr)
+		}
+
+		at := len(b) - 4
+		if crc32.Checksum(b[:at], streamCRC) != binary.LittleEndian.Uint32(b[at:]) {
+			return node, errNodeCorrupted.New(ErrCorrupted, addr)
+		}
+		b = b[:at]
+	}
+
+	if err := h.decodeNode(b, &node, version); err != nil {
+		return node, errNodeCorrupted.New(fmt.Errorf("%w: %w", ErrCorrupted, err), addr)
+	}
+
+	return node, nil
+}
+
+// node is connected to nodes beyond the heap
+func dangling[Vector any](node Node[Vector], size int) bool {
+	for _, edges := range node.Connections {
+		for _, e := range edges {
+			if int(e) >= size {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// loaded heap must not contain dangling pointers
+func (h *HNSW[Vector]) checkPointers() error {
+	if len(h.heap) > 0 && int(h.head) >= len(h.heap) {
+		return errCodec.New(fmt.Errorf("%w: head %d is beyond the heap", ErrCorrupted, h.head))
+	}
+
+	for addr, node := range h.heap {
+		if dangling(node, len(h.heap)) {
+			return errNodeDangling.New(ErrCorrupted, Pointer(addr))
+		}
+	}
+
+	return nil
+}
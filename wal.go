@@ -0,0 +1,358 @@
+//
+// Copyright (C) 2024 Dmitry Kolesnikov
+//
+// This file may be modified and distributed under the terms
+// of the MIT license.  See the LICENSE file for details.
+// https://github.com/fogfish/hnsw
+//
+
+package hnsw
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+// Write-ahead log file format, the log is a sequence of records
+//
+//	op byte | length uint32 | binary encoded vector | CRC32 (Castagnoli)
+//
+// The log is replayed until the first incomplete or corrupted record, it is
+// the tail torn by the crash. All integers are little endian.
+const (
+	walInsert = byte(1)
+	walDelete = byte(2)
+
+	// sanity limit on the size of encoded vector
+	walMaxRecord = 1 << 24
+)
+
+// Append-only write-ahead log of index operations. It records every insert
+// and delete since the last snapshot, so that the index is recovered after
+// the crash. See WithWAL and Recover for details.
+type WAL struct {
+	mu    sync.Mutex
+	fd    *os.File
+	size  int64
+	every time.Duration
+	err   error
+	done  chan struct{}
+	wg    sync.WaitGroup
+}
+
+// Open write-ahead log, the file is created if it does not exist.
+//
+// The interval defines fsync policy. The log is synced after each record
+// if the interval is 0, periodically if the interval is positive and never
+// if it is negative (syncing is left to the operating system). Records are
+// written to the file before the operation returns, they survive the crash of
+// the process. Records that are not synced are lost if the host crashes.
+func OpenWAL(path string, every time.Duration) (*WAL, error) {
+	fd, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, errIO.New(err)
+	}
+
+	fi, err := fd.Stat()
+	if err != nil {
+		fd.Close()
+		return nil, errIO.New(err)
+	}
+
+	// discard the torn tail, new records have to follow the valid ones
+	size, err := walScan(io.NewSectionReader(fd, 0, fi.Size()), nil)
+	if err != nil {
+		fd.Close()
+		return nil, err
+	}
+
+	if size != fi.Size() {
+		if err := fd.Truncate(size); err != nil {
+			fd.Close()
+			return nil, errIO.New(err)
+		}
+	}
+
+	wal := &WAL{
+		fd:    fd,
+		size:  size,
+		every: every,
+		done:  make(chan struct{}),
+	}
+
+	if every > 0 {
+		wal.wg.Add(1)
+		go wal.syncer()
+	}
+
+	return wal, nil
+}
+
+func (wal *WAL) syncer() {
+	defer wal.wg.Done()
+
+	ticker := time.NewTicker(wal.every)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-wal.done:
+			return
+		case <-ticker.C:
+			wal.Sync()
+		}
+	}
+}
+
+// Sync the log to stable storage. It returns the first error of the log,
+// write errors are sticky.
+func (wal *WAL) Sync() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.err != nil {
+		return wal.err
+	}
+
+	if err := wal.fd.Sync(); err != nil {
+		wal.err = errIO.New(err)
+	}
+
+	return wal.err
+}
+
+// Err returns the first error of the log, write errors are sticky. Operations
+// without error return (e.g. Insert, Delete) are logged silently, check Err
+// or Sync before acknowledging them.
+func (wal *WAL) Err() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	return wal.err
+}
+
+// record the first error of the log
+func (wal *WAL) fail(err error) error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.err == nil {
+		wal.err = err
+	}
+
+	return wal.err
+}
+
+// Close the log, syncing it unless the fsync policy is never.
+func (wal *WAL) Close() error {
+	close(wal.done)
+	wal.wg.Wait()
+
+	var err error
+	if wal.every >= 0 {
+		err = wal.Sync()
+	}
+
+	if cerr := wal.fd.Close(); cerr != nil && err == nil {
+		err = errIO.New(cerr)
+	}
+
+	return err
+}
+
+func (wal *WAL) append(op byte, b []byte) error {
+	var buf bytes.Buffer
+	sw := newStreamWriter(&buf)
+	sw.bytes([]byte{op})
+	sw.uint32(uint32(len(b)))
+	sw.bytes(b)
+	sw.checksum()
+	sw.flush()
+
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.err != nil {
+		return wal.err
+	}
+
+	n, err := wal.fd.Write(buf.Bytes())
+	wal.size += int64(n)
+	if err != nil {
+		wal.err = errIO.New(err)
+		return wal.err
+	}
+
+	if wal.every == 0 {
+		if err := wal.fd.Sync(); err != nil {
+			wal.err = errIO.New(err)
+			return wal.err
+		}
+	}
+
+	return nil
+}
+
+// discard all records, the index is persisted
+func (wal *WAL) truncate() error {
+	wal.mu.Lock()
+	defer wal.mu.Unlock()
+
+	if wal.err != nil {
+		return wal.err
+	}
+
+	if err := wal.fd.Truncate(0); err != nil {
+		wal.err = errIO.New(err)
+		return wal.err
+	}
+	wal.size = 0
+
+	if wal.every >= 0 {
+		if err := wal.fd.Sync(); err != nil {
+			wal.err = errIO.New(err)
+			return wal.err
+		}
+	}
+
+	return nil
+}
+
+// replay records of the log
+func (wal *WAL) replay(f func(op byte, b []byte) error) error {
+	wal.mu.Lock()
+	size := wal.size
+	wal.mu.Unlock()
+
+	_, err := walScan(io.NewSectionReader(wal.fd, 0, size), f)
+	return err
+}
+
+// scan records of the log, it returns the length of valid prefix.
+func walScan(r io.Reader, f func(op byte, b []byte) error) (int64, error) {
+	sr := newStreamReader(r)
+
+	var size int64
+	for {
+		op := sr.bytes(1)[0]
+		n := sr.uint32()
+		if sr.err != nil || n > walMaxRecord {
+			return size, nil
+		}
+
+		b := sr.bytes(int(n))
+		if err := sr.checksum("wal"); err != nil {
+			return size, nil
+		}
+
+		if op != walInsert && op != walDelete {
+			return size, errCodec.New(fmt.Errorf("invalid wal record %d at %d", op, size))
+		}
+
+		if f != nil {
+			if err := f(op, b); err != nil {
+				return size, err
+			}
+		}
+
+		size = sr.n
+	}
+}
+
+//------------------------------------------------------------------------------
+
+// append operation to write-ahead log, if it is configured
+func (h *HNSW[Vector]) log(op byte, v Vector) error {
+	if h.config.wal == nil {
+		return nil
+	}
+
+	b, err := h.encodeVector(v)
+	if err != nil {
+		return h.config.wal.fail(errCodec.New(err))
+	}
+
+	return h.config.wal.append(op, b)
+}
+
+// discard write-ahead log, if it is configured
+func (h *HNSW[Vector]) truncateLog() error {
+	if h.config.wal == nil {
+		return nil
+	}
+
+	return h.config.wal.truncate()
+}
+
+// Recover index from the last snapshot and write-ahead log.
+//
+// The snapshot is read from the storage using Read, the index remains empty
+// if the storage has no snapshot. Operations recorded after the snapshot are
+// replayed from the log configured by WithWAL. Replayed nodes are persisted
+// by the following Write or WriteDelta, which truncates the log.
+func (h *HNSW[Vector]) Recover(r Reader) error {
+	if err := h.readSnapshot(r, h.Read); err != nil {
+		return err
+	}
+
+	return h.replay(
+		func(v Vector) {
+			h.rwCompact.RLock()
+			defer h.rwCompact.RUnlock()
+
+			h.insert(context.Background(), v, true)
+		},
+		func(v Vector) {
+			h.rwCompact.RLock()
+			defer h.rwCompact.RUnlock()
+
+			if addr, has := h.lookup(v); has {
+				h.deletePointer(addr)
+			}
+		},
+	)
+}
+
+// read snapshot if it exists
+func (h *HNSW[Vector]) readSnapshot(r Reader, read func(Reader) error) error {
+	b, err := r.Get([]byte("&root"))
+	if err != nil {
+		return errIO.New(err)
+	}
+
+	if len(b) == 0 {
+		return nil
+	}
+
+	return read(r)
+}
+
+// replay write-ahead log, operations are not logged again
+func (h *HNSW[Vector]) replay(insert func(Vector), delete func(Vector)) error {
+	if h.config.wal == nil {
+		return nil
+	}
+
+	return h.config.wal.replay(
+		func(op byte, b []byte) error {
+			v, err := h.decodeVector(b)
+			if err != nil {
+				return errCodec.New(err)
+			}
+
+			switch op {
+			case walInsert:
+				insert(v)
+			case walDelete:
+				delete(v)
+			}
+
+			return nil
+		},
+	)
+}